@@ -0,0 +1,94 @@
+package main
+
+// 生成JWT签名用的密钥对
+// 用法: go run ./cmd/genkeys -alg EdDSA -kid key-2 -out ./internal/router/middleware
+// 生成 <kid>.private.key (PKCS#8) 和 <kid>.public.key (PKIX) 两个PEM文件 然后加入 config.yaml 的 jwt.keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	alg := flag.String("alg", "RS256", "签名算法 RS256、ES256、EdDSA")
+	kid := flag.String("kid", "", "密钥标识 用作文件名前缀")
+	out := flag.String("out", ".", "输出目录")
+	bits := flag.Int("bits", 2048, "RSA密钥长度 仅RS256生效")
+	flag.Parse()
+
+	if *kid == "" {
+		fmt.Fprintln(os.Stderr, "必须指定 -kid")
+		os.Exit(2)
+	}
+	privateKey, publicKey, err := generate(*alg, *bits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成密钥失败 err:%v\n", err)
+		os.Exit(1)
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "编码私钥失败 err:%v\n", err)
+		os.Exit(1)
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "编码公钥失败 err:%v\n", err)
+		os.Exit(1)
+	}
+	privatePath := filepath.Join(*out, *kid+".private.key")
+	publicPath := filepath.Join(*out, *kid+".public.key")
+	// 私钥只允许当前用户读写
+	if err := writePEM(privatePath, "PRIVATE KEY", privateDer, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "写入私钥失败 err:%v\n", err)
+		os.Exit(1)
+	}
+	if err := writePEM(publicPath, "PUBLIC KEY", publicDer, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "写入公钥失败 err:%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("已生成 %s 密钥\n  kid: %s\n  private_key: %s\n  public_key: %s\n", *alg, *kid, privatePath, publicPath)
+}
+
+func generate(alg string, bits int) (crypto.PrivateKey, crypto.PublicKey, error) {
+	switch alg {
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "ES256":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "EdDSA":
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, publicKey, nil
+	}
+	return nil, nil, fmt.Errorf("不支持的算法:%v", alg)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	// O_EXCL 防止覆盖已有密钥
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+}
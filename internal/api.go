@@ -3,9 +3,14 @@ package internal
 import (
 	"context"
 	"fmt"
+	"ginwebproject1/internal/cache"
 	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/mailer"
 	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
 	"ginwebproject1/internal/router"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
 	"io"
 	"os"
 	"strings"
@@ -26,9 +31,15 @@ import (
 func Exec() *gin.Engine {
 	InitConfig()
 	InitLogger()
+	InitPassword()
 	InitMysql()
+	InitRBAC()
 	InitRedis()
-	// InitLocalCache()
+	InitJWT()
+	InitMailer()
+	InitOIDC()
+	InitLocalCache()
+	InitBloom()
 	return router.InitRouter()
 }
 
@@ -39,6 +50,56 @@ func InitConfig() {
 	// 设置viper
 	v := viper.New()
 	v.SetConfigFile(configFileName)
+	// 默认值 配置文件未填写时生效
+	v.SetDefault("jwt.access_expire", "15m")
+	v.SetDefault("jwt.refresh_expire", "168h")
+	v.SetDefault("jwt.issuer", "ginwebproject1")
+	v.SetDefault("jwt.audience", "ginwebproject1")
+	v.SetDefault("jwt.clock_skew", "30s")
+	v.SetDefault("jwt.cookie.name", "access_token")
+	v.SetDefault("jwt.cookie.refresh_name", "refresh_token")
+	v.SetDefault("jwt.cookie.same_site", "lax")
+	v.SetDefault("jwt.cookie.csrf_cookie", "csrf_token")
+	v.SetDefault("jwt.cookie.csrf_header", "X-CSRF-Token")
+	v.SetDefault("mail.driver", "log")
+	v.SetDefault("mail.outbox", "./logs/outbox")
+	v.SetDefault("password.reset_expire", "30m")
+	v.SetDefault("password.algorithm", "argon2id")
+	v.SetDefault("password.argon2.memory", 64*1024)
+	v.SetDefault("password.argon2.iterations", 3)
+	v.SetDefault("password.argon2.parallelism", 2)
+	v.SetDefault("password.bcrypt_cost", 10)
+	v.SetDefault("mail.smtp.port", 587)
+	v.SetDefault("register.verify_expire", "24h")
+	v.SetDefault("register.resend_interval", "60s")
+	v.SetDefault("login_guard.max_failures", 10)
+	v.SetDefault("login_guard.ip_max_failures", 100)
+	v.SetDefault("login_guard.lockout", "15m")
+	v.SetDefault("login_guard.backoff_after", 3)
+	v.SetDefault("login_guard.backoff_base", "1s")
+	v.SetDefault("login_guard.backoff_max", "1m")
+	v.SetDefault("mfa.issuer", "ginwebproject1")
+	v.SetDefault("mfa.skew", 1)
+	v.SetDefault("mfa.pending_expire", "5m")
+	v.SetDefault("mfa.max_attempts", 5)
+	v.SetDefault("mfa.recovery_codes", 10)
+	v.SetDefault("api_key.default_ttl", "2160h")
+	v.SetDefault("api_key.max_ttl", "8760h")
+	v.SetDefault("api_key.max_per_user", 20)
+	v.SetDefault("oidc.state_expire", "10m")
+	v.SetDefault("oauth.audience", "ginwebproject1-apps")
+	v.SetDefault("oauth.access_expire", "1h")
+	v.SetDefault("oauth.code_expire", "1m")
+	v.SetDefault("oauth.request_expire", "10m")
+	v.SetDefault("local_cache.life_window", "10m")
+	v.SetDefault("local_cache.max_size", 64)
+	v.SetDefault("local_cache.user_ttl", "30s")
+	v.SetDefault("cache.user_ttl", "24h")
+	v.SetDefault("cache.jitter", 0.1)
+	v.SetDefault("cache.negative_ttl", "1m")
+	v.SetDefault("bloom.expected_items", 1000000)
+	v.SetDefault("bloom.false_positive", 0.01)
+	v.SetDefault("bloom.rebuild_after", 10000)
 
 	// 错误检查
 	if err := v.ReadInConfig(); err != nil {
@@ -48,7 +109,30 @@ func InitConfig() {
 	if err := v.Unmarshal(&config.Config); err != nil {
 		zap.S().Panicf("解析配置文件失败 err:%v", err)
 	}
-	fmt.Printf("配置文件加载成功：%+v\n", config.Config)
+	// 配置中包含密码、密钥等敏感信息 不输出具体内容
+	fmt.Printf("配置文件加载成功：%v\n", configFileName)
+}
+
+func InitPassword() {
+	// 配置密码哈希算法 新密码使用 algorithm 指定的算法 其他算法只用于校验旧哈希
+	c := config.Config.PwdConf
+	params := pkg.DefaultArgon2Params
+	params.Memory = c.Argon2.Memory
+	params.Iterations = c.Argon2.Iterations
+	params.Parallelism = c.Argon2.Parallelism
+	argon2id := &pkg.Argon2idHasher{Params: params, Pepper: []byte(c.Pepper)}
+	bcrypt := &pkg.BcryptHasher{Cost: c.BcryptCost}
+	switch c.Algorithm {
+	case "argon2id":
+		pkg.SetPasswordHashers(argon2id, bcrypt)
+	case "bcrypt":
+		pkg.SetPasswordHashers(bcrypt, argon2id)
+	default:
+		zap.S().Panicf("不支持的密码哈希算法 algorithm:%v", c.Algorithm)
+	}
+	if c.Pepper == "" {
+		zap.S().Warnf("未配置 password.pepper")
+	}
 }
 
 func InitMysql() {
@@ -67,7 +151,7 @@ func InitMysql() {
 	})
 	config.DB = db
 	// 创建表
-	config.DB.AutoMigrate(&model.User{})
+	model.AutoMigrate(config.DB)
 
 	//错误处理
 	if err != nil {
@@ -77,6 +161,35 @@ func InitMysql() {
 
 }
 
+func InitRBAC() {
+	// 写入内置权限和管理员角色 并给配置中的用户分配管理员角色
+	perms := make([]model.Permission, 0, len(model.AllPermissions))
+	for _, name := range model.AllPermissions {
+		p := model.Permission{Name: name}
+		if err := config.DB.Where("name = ?", name).FirstOrCreate(&p).Error; err != nil {
+			zap.S().Panicf("初始化权限失败 permission:%v err:%v", name, err)
+		}
+		perms = append(perms, p)
+	}
+	admin := model.Role{Name: model.RoleAdmin}
+	if err := config.DB.Where("name = ?", admin.Name).FirstOrCreate(&admin).Error; err != nil {
+		zap.S().Panicf("初始化管理员角色失败 err:%v", err)
+	}
+	if err := config.DB.Model(&admin).Association("Permissions").Replace(perms); err != nil {
+		zap.S().Panicf("初始化管理员权限失败 err:%v", err)
+	}
+	for _, username := range config.Config.RBACConf.Admins {
+		var u model.User
+		if err := config.DB.Where("username = ?", username).First(&u).Error; err != nil {
+			zap.S().Warnf("配置的管理员用户不存在 username:%v err:%v", username, err)
+			continue
+		}
+		if err := config.DB.Model(&u).Association("Roles").Append(&admin); err != nil {
+			zap.S().Panicf("分配管理员角色失败 username:%v err:%v", username, err)
+		}
+	}
+}
+
 func InitRedis() {
 	//  空的、根级别的上下文对象（context），可以传递取消信号的管道
 	ctx := context.Background()
@@ -96,19 +209,91 @@ func InitRedis() {
 	config.RedisClient = redisClient
 }
 
+func InitJWT() {
+	// 启动时一次性加载并解析密钥 密钥有问题直接启动失败
+	if err := middleware.InitJWT(); err != nil {
+		zap.S().Panicf("JWT密钥加载失败 err:%v", err)
+	}
+	// 授权给其他应用的访问令牌不能当作本服务的登录凭证使用
+	if config.Config.OAuthConf.Audience == config.Config.JWTConf.Audience {
+		zap.S().Panicf("oauth.audience 不能与 jwt.audience 相同")
+	}
+	if config.Config.JWTConf.Watch {
+		if err := middleware.WatchKeys(); err != nil {
+			zap.S().Panicf("JWT密钥监听失败 err:%v", err)
+		}
+	}
+}
+
+func InitMailer() {
+	// 根据配置选择邮件发送方式
+	c := config.Config.MailConf
+	switch c.Driver {
+	case "log":
+		mailer.Default = mailer.LogMailer{}
+	case "file":
+		mailer.Default = mailer.FileMailer{From: c.From, Dir: c.Outbox}
+	case "smtp":
+		mailer.Default = mailer.SMTPMailer{
+			From:     c.From,
+			Host:     c.SMTP.Host,
+			Port:     c.SMTP.Port,
+			Username: c.SMTP.Username,
+			Password: c.SMTP.Password,
+		}
+	default:
+		zap.S().Panicf("不支持的邮件发送方式 driver:%v", c.Driver)
+	}
+}
+
+func InitOIDC() {
+	// 创建第三方登录的提供方 测试提供方可以冒充任意邮箱 生产环境禁止开启
+	if config.Config.OIDCConf.Fake {
+		if config.Config.Mode == gin.ReleaseMode {
+			zap.S().Panicf("release 模式下禁止开启 oidc.fake")
+		}
+		zap.S().Warnf("已开启内置的测试OIDC提供方 只能用于开发和测试")
+	}
+	if err := oidc.Init(); err != nil {
+		zap.S().Panicf("OIDC初始化失败 err:%v", err)
+	}
+}
+
 func InitLocalCache() {
 	// 初始化本地缓存
 	// 适用于热数据、短期使用的数据
-	// 设置缓存中每个条目的生命周期 有效时间设置为永久
-	interval := 8760 * 100 * time.Hour
+	// 多实例部署时通过redis通知删除其他实例的本地缓存 通知丢失时靠较短的有效期兜底
+	conf := config.Config.LocalCacheConf
+	if !conf.Enable {
+		return
+	}
 	//  创建默认配置，bigcache.Config 包含缓存的大小、清理间隔、并发分片数等配置
-	c := bigcache.DefaultConfig(interval)
+	// 每个条目的生命周期 各类数据另有各自更短的有效期
+	c := bigcache.DefaultConfig(conf.LifeWindow)
+	c.CleanWindow = time.Minute
+	c.HardMaxCacheSize = conf.MaxSize
+	c.Verbose = false
 	ctx := context.Background()
 	localCache, err := bigcache.New(ctx, c)
 	if err != nil {
 		zap.S().Panicf("初始化本地缓存失败 err:%+v", err)
 	}
 	config.LocalCache = localCache
+	// 其他实例修改数据后通过redis通知删除本地缓存
+	cache.StartInvalidationListener(ctx)
+}
+
+func InitBloom() {
+	// 用户id和用户名的布隆过滤器 拦截不存在的用户的查询
+	// 过滤器建立之前所有查询按可能存在处理 启动时在后台从数据库重建
+	if !config.Config.BloomConf.Enable {
+		return
+	}
+	go func() {
+		if err := cache.RebuildUserBloom(context.Background()); err != nil {
+			zap.S().Errorf("InitBloom.RebuildUserBloom err:%v", err)
+		}
+	}()
 }
 
 func InitLogger() {
@@ -1,5 +1,7 @@
 package api
 
+import "time"
+
 type RegisterRequest struct {
 	// binding:"required"：字段不能为空。
 	// binding:"required,email"：字段不能为空，且必须符合邮箱格式。
@@ -16,3 +18,272 @@ type LoginRequest struct {
 type UpdateRequest struct {
 	Username string `json:"username" binding:"required"`
 }
+
+type RefreshRequest struct {
+	// cookie模式下可以为空 从cookie中读取
+	RefreshToken string `json:"refresh_token"`
+}
+
+// 登录和刷新成功后返回的令牌对
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token 剩余秒数
+}
+
+type LogoutRequest struct {
+	// 可选 同时吊销该 refresh token 所在的家族
+	RefreshToken string `json:"refresh_token"`
+}
+
+type SetRolesRequest struct {
+	// 角色名列表 为空表示清除所有角色
+	Roles []string `json:"roles"`
+}
+
+// 管理后台用户列表查询参数
+type ListUsersRequest struct {
+	Cursor      string    `form:"cursor"`                                                   // 上一页返回的 next_cursor 为空表示第一页
+	Limit       int       `form:"limit" binding:"omitempty,min=1,max=100"`                  // 每页条数 默认20
+	Q           string    `form:"q"`                                                        // 用户名或邮箱模糊搜索
+	EmailDomain string    `form:"email_domain"`                                             // 邮箱域名 如 example.com
+	Status      string    `form:"status" binding:"omitempty,oneof=pending active disabled"` // 用户状态
+	CreatedFrom time.Time `form:"created_from" time_format:"2006-01-02"`                    // 注册时间起 包含
+	CreatedTo   time.Time `form:"created_to" time_format:"2006-01-02"`                      // 注册时间止 包含当天
+	Sort        string    `form:"sort" binding:"omitempty,oneof=id created_at username"`
+	Order       string    `form:"order" binding:"omitempty,oneof=asc desc"` // 默认desc
+}
+
+// 管理后台展示的用户信息 不包含密码
+type UserItem struct {
+	ID        uint      `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Status    string    `json:"status"`
+	Roles     []string  `json:"roles"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 游标分页信息
+type Paging struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor"`
+	HasMore    bool   `json:"has_more"`
+}
+
+type UserListResponse struct {
+	List   []UserItem `json:"list"`
+	Paging Paging     `json:"paging"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ResendVerifyEmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// 开启两步验证的账号 密码正确后返回该响应 代替令牌对
+type MFAPendingResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"` // mfa_token 剩余秒数
+}
+
+// 登录第二步 code 可以是验证器中的6位验证码或一次性恢复码
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type MFAStatusResponse struct {
+	Enabled           bool  `json:"enabled"`
+	RecoveryCodesLeft int64 `json:"recovery_codes_left"` // 未使用的恢复码数量
+}
+
+// 发起绑定 返回密钥和用于生成二维码的地址
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableMFARequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// 恢复码只在生成时返回一次
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// 登录会话 即一台设备上的一次登录
+type SessionItem struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`      // 登录ip
+	LastIP    string    `json:"last_ip"` // 最近访问ip
+	MFA       bool      `json:"mfa"`     // 是否通过两步验证登录
+	Current   bool      `json:"current"` // 是否为发起请求的会话
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// 安全事件查询参数 时间为 RFC3339 格式
+type SecurityEventsRequest struct {
+	Cursor string    `form:"cursor"`                                  // 上一页返回的 next_cursor
+	Limit  int       `form:"limit" binding:"omitempty,min=1,max=100"` // 每页条数 默认20
+	Type   string    `form:"type"`                                    // 事件类型
+	From   time.Time `form:"from"`                                    // 起始时间 包含
+	To     time.Time `form:"to"`                                      // 截止时间 不包含
+}
+
+// 管理后台查询 额外支持按用户过滤
+type AdminSecurityEventsRequest struct {
+	SecurityEventsRequest
+	UserID   uint   `form:"user_id"`
+	Username string `form:"username"`
+}
+
+type SecurityEventItem struct {
+	ID        uint      `json:"id"`
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SecurityEventListResponse struct {
+	List   []SecurityEventItem `json:"list"`
+	Paging Paging              `json:"paging"`
+}
+
+// 第三方登录绑定的身份
+type IdentityItem struct {
+	ID        uint      `json:"id"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required,max=64"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"` // profile 或权限名 如 users:read
+	ExpiresAt *time.Time `json:"expires_at"`                      // 为空时使用默认有效期
+}
+
+type APIKeyItem struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	MFA        bool       `json:"mfa"` // 创建时是否通过了两步验证登录 否则不能访问要求两步验证的接口
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// 明文key只在创建时返回一次
+type CreateAPIKeyResponse struct {
+	APIKeyItem
+	Key string `json:"key"`
+}
+
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name" binding:"required,max=64"`
+	RedirectURIs []string `json:"redirect_uris"`                        // 授权码方式必填 回调时完全匹配
+	Scopes       []string `json:"scopes" binding:"required,min=1"`      // 允许申请的scope
+	GrantTypes   []string `json:"grant_types" binding:"required,min=1"` // authorization_code、client_credentials
+	Public       bool     `json:"public"`                               // 公开客户端 不生成密钥
+}
+
+type OAuthClientItem struct {
+	ID           uint      `json:"id"`
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	GrantTypes   []string  `json:"grant_types"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// 密钥只在注册时返回一次
+type CreateOAuthClientResponse struct {
+	OAuthClientItem
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// 授权确认页展示的内容
+type OAuthConsentInfo struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	Granted    bool     `json:"granted"` // 用户此前已同意过这些scope 确认页可以直接提交
+}
+
+type OAuthConsentRequest struct {
+	Approve bool `json:"approve"`
+}
+
+// 前端跳转到该地址 把授权结果交给应用
+type OAuthConsentResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// 用户已授权的应用
+type OAuthConsentItem struct {
+	ID         uint      `json:"id"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// 令牌端点的响应 RFC 6749
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// 令牌自省的响应 RFC 7662 令牌无效时只返回 active=false
+type OAuthIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
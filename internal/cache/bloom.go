@@ -0,0 +1,376 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 检查是否全部位都为1 返回 -1 表示过滤器不可用 调用方按可能存在处理
+// 过滤器不存在(尚未建立或已被清除)或建立时的参数与当前配置不同时不可用
+// KEYS[1] 过滤器 KEYS[2] 过滤器参数  ARGV[1] 当前参数 ARGV[2:] 位偏移
+var bloomCheckScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= ARGV[1] or redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+for i = 2, #ARGV do
+	if redis.call('GETBIT', KEYS[1], ARGV[i]) == 0 then
+		return 0
+	end
+end
+return 1
+`)
+
+// 只写入已存在且参数相同的过滤器 避免在未填充完成的过滤器上判断为不存在
+// 参数不同的过滤器无法按当前配置写入 直接删除 重建前一律按可能存在处理
+// KEYS 依次为 过滤器、过滤器参数、正在重建的过滤器、其参数  ARGV[1] 当前参数 ARGV[2:] 位偏移
+var bloomAddScript = redis.NewScript(`
+for k = 1, #KEYS, 2 do
+	local params = redis.call('GET', KEYS[k + 1])
+	if params == ARGV[1] then
+		if redis.call('EXISTS', KEYS[k]) == 1 then
+			for i = 2, #ARGV do
+				redis.call('SETBIT', KEYS[k], ARGV[i], 1)
+			end
+		end
+	elseif params then
+		redis.call('DEL', KEYS[k], KEYS[k + 1])
+	end
+end
+return 1
+`)
+
+// 重建完成后替换 临时过滤器不完整(被删除或参数已变化)时放弃
+// KEYS[1] 临时过滤器 KEYS[2] 其参数 KEYS[3] 过滤器 KEYS[4] 过滤器参数  ARGV[1] 建立时的参数
+var bloomSwapScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= ARGV[1] or redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return 0
+end
+redis.call('RENAME', KEYS[1], KEYS[3])
+redis.call('RENAME', KEYS[2], KEYS[4])
+return 1
+`)
+
+// 基于 redis bitmap 的布隆过滤器 不依赖 RedisBloom 模块
+// 判断为不存在时一定不存在 判断为存在时可能误判 误判率由 bloom.false_positive 决定
+type bloomFilter struct {
+	name                string
+	checks, maybe, skip atomic.Int64 // 检查次数 可能存在次数 过滤器不可用次数
+}
+
+var (
+	userIDBloom   = newBloomFilter("user_id")
+	usernameBloom = newBloomFilter("username")
+)
+
+func newBloomFilter(name string) *bloomFilter {
+	b := &bloomFilter{name: name}
+	registerStats("bloom_"+name, b)
+	return b
+}
+
+// bf:ginwebproject1:{<name>}  布隆过滤器 集群模式下与重建用的key在同一个slot
+func (b *bloomFilter) key() string {
+	return fmt.Sprintf("bf:ginwebproject1:{%v}", b.name)
+}
+
+// bf:ginwebproject1:{<name>}:params  建立过滤器时的位数和哈希次数 m:k
+func (b *bloomFilter) paramsKey() string {
+	return b.key() + ":params"
+}
+
+// bf:ginwebproject1:{<name>}:rebuild  重建中的过滤器 完成后改名替换
+func (b *bloomFilter) rebuildKey() string {
+	return b.key() + ":rebuild"
+}
+
+// bf:ginwebproject1:{<name>}:rebuild:params  重建中的过滤器的参数
+func (b *bloomFilter) rebuildParamsKey() string {
+	return b.rebuildKey() + ":params"
+}
+
+// hits 为可能存在 misses 为确定不存在 过滤器不可用时不计入
+func (b *bloomFilter) stats() map[string]LevelStats {
+	checks, maybe := b.checks.Load(), b.maybe.Load()
+	return map[string]LevelStats{
+		"check":       {Hits: maybe, Misses: checks - maybe},
+		"unavailable": {Hits: b.skip.Load()},
+	}
+}
+
+// 按预期数量和误判率计算位数 m 和哈希次数 k
+func bloomParams() (m uint64, k int) {
+	n := float64(max(config.Config.BloomConf.ExpectedItems, 1))
+	p := config.Config.BloomConf.FalsePositive
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	bits := math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2))
+	// redis 字符串最大 512MB
+	m = uint64(min(bits, float64(uint64(1)<<32)))
+	k = max(int(math.Round(float64(m)/n*math.Ln2)), 1)
+	return m, k
+}
+
+// 过滤器参数的字符串形式 与过滤器一起保存 配置变化后旧的过滤器不可用
+func bloomParamsString() string {
+	m, k := bloomParams()
+	return fmt.Sprintf("%v:%v", m, k)
+}
+
+// 脚本参数 当前参数在前 之后为位偏移
+func bloomArgs(item string) []any {
+	return append([]any{bloomParamsString()}, bloomOffsets(item)...)
+}
+
+// 双重哈希 offset_i = h1 + i*h2 mod m
+func bloomOffsets(item string) []any {
+	m, k := bloomParams()
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:]) | 1
+	offsets := make([]any, k)
+	for i := range offsets {
+		offsets[i] = (h1 + uint64(i)*h2) % m
+	}
+	return offsets
+}
+
+func (b *bloomFilter) add(ctx context.Context, item string) {
+	if !config.Config.BloomConf.Enable {
+		return
+	}
+	keys := []string{b.key(), b.paramsKey(), b.rebuildKey(), b.rebuildParamsKey()}
+	err := bloomAddScript.Run(ctx, config.RedisClient, keys, bloomArgs(item)...).Err()
+	if err != nil {
+		// 写入失败会导致误判为不存在 删除过滤器 重建前一律按可能存在处理
+		zap.S().Errorf("bloomFilter.add name:%v err:%v 删除过滤器等待重建", b.name, err)
+		if err := config.RedisClient.Del(ctx, b.key(), b.paramsKey()).Err(); err != nil {
+			zap.S().Errorf("bloomFilter.add 删除过滤器失败 name:%v err:%v", b.name, err)
+		}
+	}
+}
+
+// 返回 false 表示一定不存在 过滤器未开启、不可用或出错时返回 true
+func (b *bloomFilter) mayExist(ctx context.Context, item string) bool {
+	if !config.Config.BloomConf.Enable {
+		return true
+	}
+	res, err := bloomCheckScript.Run(ctx, config.RedisClient, []string{b.key(), b.paramsKey()}, bloomArgs(item)...).Int()
+	if err != nil || res < 0 {
+		if err != nil {
+			zap.S().Errorf("bloomFilter.mayExist name:%v err:%v", b.name, err)
+		}
+		b.skip.Add(1)
+		return true
+	}
+	b.checks.Add(1)
+	if res == 1 {
+		b.maybe.Add(1)
+		return true
+	}
+	return false
+}
+
+// 批量检查 通过一次 pipeline 完成 返回可能存在的元素
+func (b *bloomFilter) filterMayExist(ctx context.Context, items []string) []string {
+	if !config.Config.BloomConf.Enable || len(items) == 0 {
+		return items
+	}
+	pipe := config.RedisClient.Pipeline()
+	cmds := make([]*redis.Cmd, len(items))
+	for i, item := range items {
+		cmds[i] = bloomCheckScript.Eval(ctx, pipe, []string{b.key(), b.paramsKey()}, bloomArgs(item)...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		zap.S().Errorf("bloomFilter.filterMayExist name:%v err:%v", b.name, err)
+		b.skip.Add(int64(len(items)))
+		return items
+	}
+	res := make([]string, 0, len(items))
+	for i, cmd := range cmds {
+		n, _ := cmd.Int()
+		switch {
+		case n < 0:
+			b.skip.Add(1)
+			res = append(res, items[i])
+		case n == 1:
+			b.checks.Add(1)
+			b.maybe.Add(1)
+			res = append(res, items[i])
+		default:
+			b.checks.Add(1)
+		}
+	}
+	return res
+}
+
+// 新用户写入过滤器 用户名需要在写入数据库之前加入 防止并发注册时误判为不存在
+func BloomAddUserID(ctx context.Context, userId uint) {
+	userIDBloom.add(ctx, strconv.FormatUint(uint64(userId), 10))
+}
+
+// 用户名按数据库的比较规则归一化 MySQL 的 _ci 排序规则忽略大小写 PAD SPACE 的排序规则还忽略尾部空格
+// 非ASCII字符还会按重音等规则折叠 无法在这里复现 返回 false 这类用户名不写入过滤器 查询时按可能存在处理
+func bloomUsername(username string) (string, bool) {
+	for i := 0; i < len(username); i++ {
+		if username[i] >= utf8.RuneSelf {
+			return "", false
+		}
+	}
+	return strings.ToLower(strings.TrimRight(username, " ")), true
+}
+
+func BloomAddUsername(ctx context.Context, username string) {
+	if name, ok := bloomUsername(username); ok {
+		usernameBloom.add(ctx, name)
+	}
+}
+
+func BloomUserIDMayExist(ctx context.Context, userId string) bool {
+	return userIDBloom.mayExist(ctx, userId)
+}
+
+// 过滤掉一定不存在的用户id
+func BloomFilterUserIDs(ctx context.Context, userIds []string) []string {
+	return userIDBloom.filterMayExist(ctx, userIds)
+}
+
+func BloomUsernameMayExist(ctx context.Context, username string) bool {
+	name, ok := bloomUsername(username)
+	if !ok {
+		return true
+	}
+	return usernameBloom.mayExist(ctx, name)
+}
+
+// s:ginwebproject1:bloom_stale  删除用户和修改用户名后留在过滤器中的无效元素数
+func bloomStaleKey() string {
+	return "s:ginwebproject1:bloom_stale"
+}
+
+// s:ginwebproject1:bloom_rebuild_lock  同一时间只有一个实例重建
+func bloomRebuildLockKey() string {
+	return "s:ginwebproject1:bloom_rebuild_lock"
+}
+
+// 布隆过滤器不支持删除 记录无效元素数 超过 bloom.rebuild_after 后在后台重建
+func BloomUserRemoved(ctx context.Context) {
+	if !config.Config.BloomConf.Enable {
+		return
+	}
+	n, err := config.RedisClient.Incr(ctx, bloomStaleKey()).Result()
+	if err != nil {
+		zap.S().Errorf("BloomUserRemoved.Incr err:%v", err)
+		return
+	}
+	// 超过后每次都尝试 重建失败时下一次删除会再次触发 同一时间只有一个重建由锁保证
+	if after := config.Config.BloomConf.RebuildAfter; after > 0 && n >= after {
+		go func() {
+			if err := RebuildUserBloom(context.Background()); err != nil {
+				zap.S().Errorf("BloomUserRemoved.RebuildUserBloom err:%v", err)
+			}
+		}()
+	}
+}
+
+// 从数据库重建用户id和用户名的过滤器 先写入临时key 完成后改名替换
+// 重建期间新增的用户同时写入临时key 不会遗漏
+func RebuildUserBloom(ctx context.Context) error {
+	if !config.Config.BloomConf.Enable {
+		return nil
+	}
+	ok, err := config.RedisClient.SetNX(ctx, bloomRebuildLockKey(), 1, 10*time.Minute).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		zap.S().Infof("RebuildUserBloom 其他实例正在重建 跳过")
+		return nil
+	}
+	defer config.RedisClient.Del(context.WithoutCancel(ctx), bloomRebuildLockKey())
+
+	start := time.Now()
+	m, _ := bloomParams()
+	params := bloomParamsString()
+	filters := []*bloomFilter{userIDBloom, usernameBloom}
+	// 先创建临时key 之后注册的用户会同时写入
+	pipe := config.RedisClient.Pipeline()
+	for _, b := range filters {
+		pipe.Del(ctx, b.rebuildKey())
+		pipe.Set(ctx, b.rebuildParamsKey(), params, 0)
+		pipe.SetBit(ctx, b.rebuildKey(), int64(m-1), 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	var users []model.User
+	var total int
+	var lastID uint
+	tx := config.DB.WithContext(ctx).Select("id", "username").FindInBatches(&users, 1000, func(tx *gorm.DB, batch int) error {
+		pipe := config.RedisClient.Pipeline()
+		for _, u := range users {
+			for _, off := range bloomOffsets(strconv.FormatUint(uint64(u.ID), 10)) {
+				pipe.SetBit(ctx, userIDBloom.rebuildKey(), int64(off.(uint64)), 1)
+			}
+			name, ok := bloomUsername(u.Username)
+			if !ok {
+				continue
+			}
+			for _, off := range bloomOffsets(name) {
+				pipe.SetBit(ctx, usernameBloom.rebuildKey(), int64(off.(uint64)), 1)
+			}
+		}
+		total += len(users)
+		lastID = max(lastID, users[len(users)-1].ID)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// 两个过滤器不在同一个slot 分别替换
+	for _, b := range filters {
+		keys := []string{b.rebuildKey(), b.rebuildParamsKey(), b.key(), b.paramsKey()}
+		swapped, err := bloomSwapScript.Run(ctx, config.RedisClient, keys, params).Int()
+		if err != nil {
+			return err
+		}
+		if swapped == 0 {
+			return fmt.Errorf("重建期间过滤器 %v 被删除或参数已变化", b.name)
+		}
+	}
+	if err := config.RedisClient.Del(ctx, bloomStaleKey()).Err(); err != nil {
+		return err
+	}
+	// 写入过滤器早于临时key创建 但在扫描之后才提交的新用户和新用户名 补充写入
+	// 修改用户名时先写入过滤器再更新数据库 updated_at 可能早于临时key创建 留出一分钟余量
+	users = nil
+	err = config.DB.WithContext(ctx).Select("id", "username").
+		Where("id > ? OR updated_at >= ?", lastID, start.Add(-time.Minute)).Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		BloomAddUserID(ctx, u.ID)
+		BloomAddUsername(ctx, u.Username)
+	}
+	zap.S().Infof("RebuildUserBloom 完成 users:%v bits:%v cost:%v", total, m, time.Since(start))
+	return nil
+}
@@ -0,0 +1,104 @@
+package cache_test
+
+import (
+	"context"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/testutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const password = "Passw0rd!Test"
+
+const usernameBloomKey = "bf:ginwebproject1:{username}"
+
+func TestBloomUsernameIgnoresCase(t *testing.T) {
+	testutil.Setup(t)
+	testutil.CreateUser(t, "Olivia", password)
+	ctx := context.Background()
+	for _, name := range []string{"Olivia", "olivia", "OLIVIA", "olivia  "} {
+		if !cache.BloomUsernameMayExist(ctx, name) {
+			t.Fatalf("与已有用户名只有大小写或尾部空格不同 应判断为可能存在 name:%q", name)
+		}
+	}
+	if cache.BloomUsernameMayExist(ctx, "nobody") {
+		t.Fatalf("不存在的用户名应判断为不存在")
+	}
+	// 非ASCII用户名无法按数据库规则归一化 一律按可能存在处理
+	if !cache.BloomUsernameMayExist(ctx, "Jösé") {
+		t.Fatalf("非ASCII用户名应判断为可能存在")
+	}
+}
+
+func TestBloomParamsMismatch(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "paul", password)
+	ctx := context.Background()
+
+	// 配置变化后 按旧参数建立的过滤器不可用
+	config.Config.BloomConf.FalsePositive = 0.001
+	if !cache.BloomUsernameMayExist(ctx, "nobody") {
+		t.Fatalf("参数不一致时应按可能存在处理")
+	}
+	// 无法按新参数写入 删除旧的过滤器
+	cache.BloomAddUsername(ctx, "quinn")
+	if env.Redis.Exists(usernameBloomKey) {
+		t.Fatalf("参数不一致时写入应删除过滤器")
+	}
+	if err := cache.RebuildUserBloom(ctx); err != nil {
+		t.Fatalf("RebuildUserBloom err:%v", err)
+	}
+	if !cache.BloomUsernameMayExist(ctx, "paul") || cache.BloomUsernameMayExist(ctx, "nobody") {
+		t.Fatalf("按新参数重建后应恢复可用")
+	}
+}
+
+func TestBloomRebuildAfterThreshold(t *testing.T) {
+	env := testutil.Setup(t, func(c *config.ServerConfig) {
+		c.BloomConf.RebuildAfter = 2
+	})
+	ctx := context.Background()
+	// 计数已经超过阈值 例如达到阈值时的重建没有成功
+	env.Redis.Set("s:ginwebproject1:bloom_stale", "5")
+	cache.BloomUserRemoved(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for env.Redis.Exists("s:ginwebproject1:bloom_stale") {
+		if time.Now().After(deadline) {
+			t.Fatalf("超过阈值后应触发重建")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBloomRebuildCatchesRename(t *testing.T) {
+	testutil.Setup(t)
+	u := testutil.CreateUser(t, "rose", password)
+	ctx := context.Background()
+
+	// 模拟重建扫描过该用户之后 才提交的用户名修改
+	var renamed atomic.Bool
+	err := config.DB.Callback().Query().After("gorm:query").Register("test:rename", func(db *gorm.DB) {
+		if _, ok := db.Statement.Dest.(*[]model.User); ok && renamed.CompareAndSwap(false, true) {
+			config.DB.Session(&gorm.Session{NewDB: true, SkipHooks: true}).
+				Model(&model.User{}).Where("id = ?", u.ID).Update("username", "rosa")
+		}
+	})
+	if err != nil {
+		t.Fatalf("注册回调失败 err:%v", err)
+	}
+
+	if err := cache.RebuildUserBloom(ctx); err != nil {
+		t.Fatalf("RebuildUserBloom err:%v", err)
+	}
+	if !renamed.Load() {
+		t.Fatalf("没有模拟到重建期间的修改")
+	}
+	if !cache.BloomUsernameMayExist(ctx, "rosa") {
+		t.Fatalf("重建期间修改的用户名应被补充写入")
+	}
+}
@@ -0,0 +1,15 @@
+package cache
+
+import "context"
+
+// 以其他实例的身份订阅 可以收到当前实例发布的通知 返回的函数等待订阅结束
+func ListenInvalidationAs(ctx context.Context, self string) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listenInvalidation(ctx, self)
+	}()
+	return func() { <-done }
+}
+
+var PublishInvalidation = publishInvalidation
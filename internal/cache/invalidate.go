@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// 本地缓存失效通知 某个实例修改数据后 其他实例删除本地缓存中的旧值
+type invalidation struct {
+	Node string   `json:"node"` // 发布者的实例id 收到自己的通知时忽略
+	Seq  uint64   `json:"seq"`  // 每个实例单调递增 出现跳号说明有通知丢失
+	Keys []string `json:"keys"`
+}
+
+// ch:ginwebproject1:cache_invalidate  失效通知频道
+func invalidateChannel() string {
+	return "ch:ginwebproject1:cache_invalidate"
+}
+
+// 当前实例的id 每次启动重新生成
+var nodeID = sync.OnceValue(func() string {
+	id, err := pkg.RandomToken(8)
+	if err != nil {
+		zap.S().Panicf("生成实例id失败 err:%v", err)
+	}
+	return id
+})
+
+// 发布失败同样占用序号 其他实例收到下一条通知时据此发现丢失
+// 取序号和发布在同一把锁内 保证同一实例的通知按序号顺序到达
+var (
+	publishMu     sync.Mutex
+	invalidateSeq uint64
+)
+
+// 通知其他实例删除本地缓存 发布失败只记录日志 不影响写入
+func publishInvalidation(ctx context.Context, keys ...string) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	invalidateSeq++
+	msg := invalidation{Node: nodeID(), Seq: invalidateSeq, Keys: keys}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		zap.S().Errorf("publishInvalidation.Marshal err:%v", err)
+		return
+	}
+	if err := config.RedisClient.Publish(ctx, invalidateChannel(), b).Err(); err != nil {
+		zap.S().Errorf("publishInvalidation.Publish keys:%v err:%v", keys, err)
+	}
+}
+
+// 超过该时间没有收到通知的发布者 不再记录序号 实例重启后会使用新的id
+const peerIdleTimeout = time.Hour
+
+// 发布者最后收到的序号和时间
+type peerSeq struct {
+	seq  uint64
+	seen time.Time
+}
+
+// 订阅失效通知 直到 ctx 结束 只在开启本地缓存时需要
+// 连接断开期间的通知无法补收 重新订阅成功后清空整个本地缓存
+func StartInvalidationListener(ctx context.Context) {
+	go listenInvalidation(ctx, nodeID())
+}
+
+// self 为当前实例的id 忽略自己发布的通知
+func listenInvalidation(ctx context.Context, self string) {
+	// 只处理启动时的本地缓存
+	local := config.LocalCache
+	ps := config.RedisClient.Subscribe(ctx, invalidateChannel())
+	defer ps.Close()
+	// Receive 阻塞在读取连接上 不会因为 ctx 结束返回 需要关闭订阅
+	stop := context.AfterFunc(ctx, func() { ps.Close() })
+	defer stop()
+	lastSeq := map[string]*peerSeq{}
+	lastPrune := time.Now()
+	gap := false
+	backoff := time.Second
+	for {
+		msg, err := ps.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// 下一次 Receive 时会自动重连并重新订阅
+			if !gap {
+				zap.S().Errorf("listenInvalidation 订阅中断 等待重连 err:%v", err)
+			}
+			gap = true
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" && gap {
+				flushLocal(local, "重新订阅")
+				// 断开期间发布者的序号已经变化 重新开始记录
+				clear(lastSeq)
+				gap = false
+			}
+			backoff = time.Second
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(m.Payload), &inv); err != nil {
+				zap.S().Errorf("listenInvalidation.Unmarshal payload:%v err:%v", m.Payload, err)
+				continue
+			}
+			if inv.Node == self {
+				continue
+			}
+			// 先删除本条通知的key 再判断是否有通知丢失
+			for _, key := range inv.Keys {
+				if err := local.Delete(key); err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+					zap.S().Errorf("listenInvalidation.Delete key:%v err:%v", key, err)
+				}
+			}
+			now := time.Now()
+			last, seen := lastSeq[inv.Node]
+			switch {
+			case !seen:
+				lastSeq[inv.Node] = &peerSeq{seq: inv.Seq, seen: now}
+			case inv.Seq <= last.seq:
+				// 已经处理过的序号 不会出现在正常的发布顺序中 忽略
+			case inv.Seq > last.seq+1:
+				flushLocal(local, "通知跳号")
+				fallthrough
+			default:
+				last.seq = inv.Seq
+				last.seen = now
+			}
+			if now.Sub(lastPrune) >= time.Minute {
+				for node, p := range lastSeq {
+					if now.Sub(p.seen) > peerIdleTimeout {
+						delete(lastSeq, node)
+					}
+				}
+				lastPrune = now
+			}
+		}
+	}
+}
+
+// 无法确定丢失了哪些通知时 清空整个本地缓存
+func flushLocal(local *bigcache.BigCache, reason string) {
+	zap.S().Warnf("[CacheFlush] 失效通知可能丢失 清空本地缓存 reason:%v", reason)
+	if err := local.Reset(); err != nil {
+		zap.S().Errorf("flushLocal.Reset err:%v", err)
+	}
+}
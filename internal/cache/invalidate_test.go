@@ -0,0 +1,126 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/testutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+const invalidateChannel = "ch:ginwebproject1:cache_invalidate"
+
+// 以其他实例的身份订阅失效通知 并写入一个不会被通知删除的key
+// 只有清空整个本地缓存时这个key才会消失
+// 不通过配置开启本地缓存 避免当前实例的订阅同时处理测试中的通知
+func listenAsPeer(t *testing.T) {
+	t.Helper()
+	env := testutil.Setup(t)
+	local, err := bigcache.New(context.Background(), bigcache.DefaultConfig(time.Minute))
+	if err != nil {
+		t.Fatalf("创建本地缓存失败 err:%v", err)
+	}
+	config.LocalCache = local
+	t.Cleanup(func() { local.Close(); config.LocalCache = nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := cache.ListenInvalidationAs(ctx, "peer")
+	t.Cleanup(func() { cancel(); wait() })
+	deadline := time.Now().Add(5 * time.Second)
+	for env.Redis.PubSubNumSub(invalidateChannel)[invalidateChannel] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("订阅失效通知超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := local.Set("sentinel", []byte("v")); err != nil {
+		t.Fatalf("写入本地缓存失败 err:%v", err)
+	}
+}
+
+// 等待本地缓存中的key被删除
+func waitDeleted(t *testing.T, keys ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, key := range keys {
+		for {
+			if _, err := config.LocalCache.Get(key); err != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("收到通知后应删除本地缓存 key:%v", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func flushed() bool {
+	_, err := config.LocalCache.Get("sentinel")
+	return err != nil
+}
+
+func TestInvalidationConcurrentPublish(t *testing.T) {
+	listenAsPeer(t)
+	const writers, perWriter = 20, 20
+	keys := make([]string, 0, writers*perWriter)
+	for i := range writers * perWriter {
+		key := fmt.Sprintf("s:ginwebproject1:test_invalidate:%v", i)
+		config.LocalCache.Set(key, []byte("v"))
+		keys = append(keys, key)
+	}
+
+	// 同一实例上并发写入
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				cache.PublishInvalidation(context.Background(), keys[w*perWriter+i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 每条通知的key都被删除 且没有清空本地缓存
+	waitDeleted(t, keys...)
+	if flushed() {
+		t.Fatalf("并发发布不应导致清空本地缓存")
+	}
+}
+
+func TestInvalidationSeqGap(t *testing.T) {
+	listenAsPeer(t)
+	publish := func(seq uint64, key string) {
+		t.Helper()
+		config.LocalCache.Set(key, []byte("v"))
+		b, _ := json.Marshal(map[string]any{"node": "other", "seq": seq, "keys": []string{key}})
+		if err := config.RedisClient.Publish(context.Background(), invalidateChannel, b).Err(); err != nil {
+			t.Fatalf("发布通知失败 err:%v", err)
+		}
+		waitDeleted(t, key)
+	}
+
+	publish(1, "k1")
+	publish(2, "k2")
+	// 已处理过的序号 只删除key
+	publish(2, "k2_again")
+	// 订阅按顺序处理 之后的通知处理完时 之前的通知一定已经处理完
+	publish(3, "k3")
+	if flushed() {
+		t.Fatalf("重复的序号不应清空本地缓存")
+	}
+	// 跳号 说明中间的通知丢失 先删除本条的key再清空
+	publish(5, "k5")
+	publish(6, "k6")
+	if !flushed() {
+		t.Fatalf("通知跳号时应清空本地缓存")
+	}
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"strings"
+	"time"
+)
+
+// s:ginwebproject1:login_fail:<user|ip>:<值>  连续登录失败次数
+func loginFailKey(kind, value string) string {
+	return fmt.Sprintf("s:ginwebproject1:login_fail:%v:%v", kind, value)
+}
+
+// s:ginwebproject1:login_lock:<user|ip>:<值>  锁定标记 ttl即剩余锁定时间
+func loginLockKey(kind, value string) string {
+	return fmt.Sprintf("s:ginwebproject1:login_lock:%v:%v", kind, value)
+}
+
+// 用户名不区分大小写 防止换大小写绕过计数
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// 失败次数对应的锁定时长
+// 达到 max 次锁定 lockout 超过 backoffAfter 次后按指数退避 base*2^(n-backoffAfter-1) 且不超过 backoffMax
+func lockDuration(fails, max int64) time.Duration {
+	c := config.Config.LoginGuardConf
+	if fails >= max {
+		return c.Lockout
+	}
+	if fails <= c.BackoffAfter {
+		return 0
+	}
+	d := c.BackoffBase << (fails - c.BackoffAfter - 1)
+	if d <= 0 || d > c.BackoffMax {
+		d = c.BackoffMax
+	}
+	return d
+}
+
+// 查询用户名或ip的剩余锁定时间 未锁定返回0
+func LoginLockRemaining(ctx context.Context, username, ip string) (time.Duration, error) {
+	pipe := config.RedisClient.Pipeline()
+	userTTL := pipe.PTTL(ctx, loginLockKey("user", normalizeUsername(username)))
+	ipTTL := pipe.PTTL(ctx, loginLockKey("ip", ip))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	// key 不存在时 PTTL 返回负数
+	return max(userTTL.Val(), ipTTL.Val(), 0), nil
+}
+
+// 记录一次登录失败 返回用户名的失败次数和本次产生的锁定时长
+func RecordLoginFailure(ctx context.Context, username, ip string) (int64, time.Duration, error) {
+	c := config.Config.LoginGuardConf
+	username = normalizeUsername(username)
+	pipe := config.RedisClient.TxPipeline()
+	userFails := pipe.Incr(ctx, loginFailKey("user", username))
+	pipe.Expire(ctx, loginFailKey("user", username), c.Lockout)
+	ipFails := pipe.Incr(ctx, loginFailKey("ip", ip))
+	pipe.Expire(ctx, loginFailKey("ip", ip), c.Lockout)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	userLock := lockDuration(userFails.Val(), c.MaxFailures)
+	ipLock := lockDuration(ipFails.Val(), c.IPMaxFailures)
+	pipe = config.RedisClient.Pipeline()
+	if userLock > 0 {
+		pipe.Set(ctx, loginLockKey("user", username), userFails.Val(), userLock)
+	}
+	if ipLock > 0 {
+		pipe.Set(ctx, loginLockKey("ip", ip), ipFails.Val(), ipLock)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	return userFails.Val(), max(userLock, ipLock), nil
+}
+
+// 登录成功或管理员解锁时清除用户名的失败计数和锁定
+func ResetLoginFailures(ctx context.Context, username string) error {
+	username = normalizeUsername(username)
+	_, err := config.RedisClient.Del(ctx, loginFailKey("user", username), loginLockKey("user", username)).Result()
+	return err
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// hs:ginwebproject1:mfa_pending:<token摘要>  密码校验通过 等待两步验证的登录
+func mfaPendingKey(hash string) string {
+	return fmt.Sprintf("hs:ginwebproject1:mfa_pending:%v", hash)
+}
+
+// 保存等待两步验证的登录 只保存摘要
+func SaveMFAPending(ctx context.Context, token string, userId uint, ttl time.Duration) error {
+	key := mfaPendingKey(pkg.HashToken(token))
+	pipe := config.RedisClient.TxPipeline()
+	pipe.HSet(ctx, key, "uid", userId, "attempts", 0)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 读取等待两步验证的用户id token不存在或已过期时返回 redis.Nil
+func GetMFAPending(ctx context.Context, token string) (uint, error) {
+	result, err := config.RedisClient.HGet(ctx, mfaPendingKey(pkg.HashToken(token)), "uid").Result()
+	if err != nil {
+		return 0, err
+	}
+	userId, err := strconv.ParseUint(result, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(userId), nil
+}
+
+// 只在记录存在时累加 避免过期后重新创建出没有ttl的key
+var mfaFailureScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+return redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+`)
+
+// 记录一次验证码错误 返回累计错误次数 记录已过期时返回 -1
+func RecordMFAFailure(ctx context.Context, token string) (int64, error) {
+	return mfaFailureScript.Run(ctx, config.RedisClient, []string{mfaPendingKey(pkg.HashToken(token))}).Int64()
+}
+
+// 删除等待中的登录 返回false表示已被其他请求使用
+func DeleteMFAPending(ctx context.Context, token string) (bool, error) {
+	n, err := config.RedisClient.Del(ctx, mfaPendingKey(pkg.HashToken(token))).Result()
+	return n > 0, err
+}
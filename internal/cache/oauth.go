@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 应用发起的授权请求 等待用户在确认页同意或拒绝
+type OAuthRequest struct {
+	ClientID      string   `json:"client_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	State         string   `json:"state"`
+	Nonce         string   `json:"nonce"`
+	CodeChallenge string   `json:"code_challenge"` // PKCE S256
+}
+
+// 用户同意后签发的授权码 应用用它换取令牌
+type OAuthCode struct {
+	OAuthRequest
+	UserID   uint     `json:"uid"`
+	Username string   `json:"username"`
+	AMR      []string `json:"amr"`       // 用户确认授权时的登录方式 写入 id_token
+	AuthTime int64    `json:"auth_time"` // 用户登录的时间 写入 id_token
+}
+
+// s:ginwebproject1:oauth_request:<请求id摘要>  待确认的授权请求
+func oauthRequestKey(hash string) string {
+	return fmt.Sprintf("s:ginwebproject1:oauth_request:%v", hash)
+}
+
+// s:ginwebproject1:oauth_code:<授权码摘要>  未使用的授权码
+func oauthCodeKey(hash string) string {
+	return fmt.Sprintf("s:ginwebproject1:oauth_code:%v", hash)
+}
+
+// s:ginwebproject1:oauth_revoke_before:<uid>:<client_id>  该时间点(毫秒)及之前签发给应用的访问令牌全部失效
+func oauthRevokeBeforeKey(userId uint, clientId string) string {
+	return fmt.Sprintf("s:ginwebproject1:oauth_revoke_before:%v:%v", userId, clientId)
+}
+
+func setJSON(ctx context.Context, key string, v any, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return config.RedisClient.Set(ctx, key, b, ttl).Err()
+}
+
+// take 为 true 时读取后删除 不存在或已过期时返回 redis.Nil
+func getJSON(ctx context.Context, key string, v any, take bool) error {
+	var cmd *redis.StringCmd
+	if take {
+		cmd = config.RedisClient.GetDel(ctx, key)
+	} else {
+		cmd = config.RedisClient.Get(ctx, key)
+	}
+	b, err := cmd.Bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func SaveOAuthRequest(ctx context.Context, id string, r *OAuthRequest, ttl time.Duration) error {
+	return setJSON(ctx, oauthRequestKey(pkg.HashToken(id)), r, ttl)
+}
+
+// 确认页展示授权内容时读取 不删除
+func GetOAuthRequest(ctx context.Context, id string) (*OAuthRequest, error) {
+	var r OAuthRequest
+	if err := getJSON(ctx, oauthRequestKey(pkg.HashToken(id)), &r, false); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// 用户同意或拒绝时取出并删除 每个请求只能处理一次
+func TakeOAuthRequest(ctx context.Context, id string) (*OAuthRequest, error) {
+	var r OAuthRequest
+	if err := getJSON(ctx, oauthRequestKey(pkg.HashToken(id)), &r, true); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func SaveOAuthCode(ctx context.Context, code string, oc *OAuthCode, ttl time.Duration) error {
+	return setJSON(ctx, oauthCodeKey(pkg.HashToken(code)), oc, ttl)
+}
+
+// 授权码只能使用一次
+func TakeOAuthCode(ctx context.Context, code string) (*OAuthCode, error) {
+	var oc OAuthCode
+	if err := getJSON(ctx, oauthCodeKey(pkg.HashToken(code)), &oc, true); err != nil {
+		return nil, err
+	}
+	return &oc, nil
+}
+
+// 吊销已签发给应用的该用户的访问令牌 用户撤销授权时调用
+func RevokeOAuthClientTokens(ctx context.Context, userId uint, clientId string) error {
+	// 只需保留到最后一个已签发的访问令牌过期
+	return config.RedisClient.Set(ctx, oauthRevokeBeforeKey(userId, clientId), time.Now().UnixMilli(), config.Config.OAuthConf.AccessExpire).Err()
+}
+
+// 访问令牌是否在用户撤销授权之前签发
+func IsOAuthClientTokenRevoked(ctx context.Context, userId uint, clientId string, iatMs int64) (bool, error) {
+	ts, err := config.RedisClient.Get(ctx, oauthRevokeBeforeKey(userId, clientId)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return iatMs <= ts, nil
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"time"
+)
+
+// 跳转到第三方登录前生成的参数 回调时取出校验
+type OIDCState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code_verifier
+}
+
+// s:ginwebproject1:oidc_state:<state摘要>  第三方登录的state
+func oidcStateKey(hash string) string {
+	return fmt.Sprintf("s:ginwebproject1:oidc_state:%v", hash)
+}
+
+func SaveOIDCState(ctx context.Context, state string, s *OIDCState, ttl time.Duration) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return config.RedisClient.Set(ctx, oidcStateKey(pkg.HashToken(state)), b, ttl).Err()
+}
+
+// 取出并删除state 保证回调只能处理一次 不存在或已过期时返回 redis.Nil
+func TakeOIDCState(ctx context.Context, state string) (*OIDCState, error) {
+	b, err := config.RedisClient.GetDel(ctx, oidcStateKey(pkg.HashToken(state))).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var s OIDCState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
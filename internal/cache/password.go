@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"strconv"
+	"time"
+)
+
+// s:ginwebproject1:pwd_reset:<token摘要>  密码重置token 值为用户id
+func passwordResetKey(hash string) string {
+	return fmt.Sprintf("s:ginwebproject1:pwd_reset:%v", hash)
+}
+
+// 保存密码重置token 只保存摘要
+func SavePasswordResetToken(ctx context.Context, token string, userId uint, ttl time.Duration) error {
+	_, err := config.RedisClient.Set(ctx, passwordResetKey(pkg.HashToken(token)), userId, ttl).Result()
+	return err
+}
+
+// 取出并删除密码重置token 保证只能使用一次
+// token 不存在或已过期时返回 redis.Nil
+func TakePasswordResetToken(ctx context.Context, token string) (uint, error) {
+	result, err := config.RedisClient.GetDel(ctx, passwordResetKey(pkg.HashToken(token))).Result()
+	if err != nil {
+		return 0, err
+	}
+	userId, err := strconv.ParseUint(result, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(userId), nil
+}
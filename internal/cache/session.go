@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 一次登录对应一个会话 会话id即refresh token家族id
+// 刷新令牌时会话延续 家族被吊销时会话随之失效
+type Session struct {
+	ID        string
+	UserID    uint
+	UserAgent string
+	IP        string // 登录ip
+	LastIP    string // 最近一次访问的ip
+	MFA       bool
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// hs:ginwebproject1:session:<sid>  会话的设备信息
+func sessionKey(sid string) string {
+	return fmt.Sprintf("hs:ginwebproject1:session:%v", sid)
+}
+
+func CreateSession(ctx context.Context, s *Session, ttl time.Duration) error {
+	key := sessionKey(s.ID)
+	pipe := config.RedisClient.TxPipeline()
+	pipe.HSet(ctx, key, map[string]any{
+		"uid":        s.UserID,
+		"user_agent": s.UserAgent,
+		"ip":         s.IP,
+		"last_ip":    s.IP,
+		"mfa":        s.MFA,
+		"created_at": s.CreatedAt.Unix(),
+		"last_seen":  s.CreatedAt.Unix(),
+	})
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 会话的登录时间 刷新令牌后保持不变 会话不存在时返回 redis.Nil
+func SessionCreatedAt(ctx context.Context, sid string) (time.Time, error) {
+	ts, err := config.RedisClient.HGet(ctx, sessionKey(sid), "created_at").Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// 只更新仍然存在的会话 避免已吊销的会话被重新写入
+// ARGV: 当前时间 ip 新的ttl毫秒(0表示不修改)
+var touchSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_seen', ARGV[1], 'last_ip', ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// 记录会话的最近访问 ttl大于0时同时续期 刷新令牌时使用
+func TouchSession(ctx context.Context, sid, ip string, ttl time.Duration) error {
+	return touchSessionScript.Run(ctx, config.RedisClient, []string{sessionKey(sid)},
+		time.Now().Unix(), ip, ttl.Milliseconds()).Err()
+}
+
+// 用户当前有效的会话 按最近访问时间倒序
+// 已过期或已吊销的会话会顺带从用户的家族集合中移除
+func ListSessions(ctx context.Context, userId uint) ([]*Session, error) {
+	sids, err := config.RedisClient.SMembers(ctx, userRefreshFamilyKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := config.RedisClient.Pipeline()
+	details := make([]*redis.MapStringStringCmd, len(sids))
+	alive := make([]*redis.IntCmd, len(sids))
+	for i, sid := range sids {
+		details[i] = pipe.HGetAll(ctx, sessionKey(sid))
+		alive[i] = pipe.Exists(ctx, refreshFamilyKey(sid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(sids))
+	var stale []any
+	for i, sid := range sids {
+		m := details[i].Val()
+		if len(m) == 0 || alive[i].Val() == 0 {
+			stale = append(stale, sid)
+			continue
+		}
+		created, _ := strconv.ParseInt(m["created_at"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(m["last_seen"], 10, 64)
+		sessions = append(sessions, &Session{
+			ID:        sid,
+			UserID:    userId,
+			UserAgent: m["user_agent"],
+			IP:        m["ip"],
+			LastIP:    m["last_ip"],
+			MFA:       m["mfa"] == "1",
+			CreatedAt: time.Unix(created, 0),
+			LastSeen:  time.Unix(lastSeen, 0),
+		})
+	}
+	if len(stale) > 0 {
+		if err := config.RedisClient.SRem(ctx, userRefreshFamilyKey(userId), stale...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+// 吊销用户的某个会话 会话不属于该用户时返回 false
+// 会话的refresh token立即失效 已签发的access token由 VerifyJWT 拒绝
+func RevokeSession(ctx context.Context, userId uint, sid string) (bool, error) {
+	ok, err := config.RedisClient.SIsMember(ctx, userRefreshFamilyKey(userId), sid).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	pipe := config.RedisClient.TxPipeline()
+	pipe.Del(ctx, refreshFamilyKey(sid), sessionKey(sid))
+	pipe.SRem(ctx, userRefreshFamilyKey(userId), sid)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
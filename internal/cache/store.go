@@ -0,0 +1,486 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// 缓存层级
+const (
+	LevelLocal  = "local" // 进程内 bigcache
+	LevelRedis  = "redis"
+	LevelDB     = "db" // 回源 命中表示数据存在
+	LevelFlight = "singleflight"
+)
+
+// 单个层级的命中次数
+type LevelStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+type levelCounter struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (l *levelCounter) record(hit bool) {
+	if hit {
+		l.hits.Add(1)
+	} else {
+		l.misses.Add(1)
+	}
+}
+
+// s:ginwebproject1:<name>:<id>  按 key 规范生成缓存key name 为数据类型 如 user
+func StringKey[K any](name string) func(id K) string {
+	return func(id K) string {
+		return fmt.Sprintf("s:ginwebproject1:%v:%v", name, id)
+	}
+}
+
+// redis 有效期策略 返回 0 表示不过期
+type TTLPolicy interface {
+	TTL() time.Duration
+}
+
+// 固定有效期
+type FixedTTL time.Duration
+
+func (d FixedTTL) TTL() time.Duration {
+	return time.Duration(d)
+}
+
+// 在 Base 上随机增加 0 ~ Jitter 比例的时长 如0.1 避免同一批数据同时过期
+type JitterTTL struct {
+	Base   time.Duration
+	Jitter float64
+}
+
+func (p JitterTTL) TTL() time.Duration {
+	if p.Base <= 0 || p.Jitter <= 0 {
+		return p.Base
+	}
+	return p.Base + time.Duration(rand.Int64N(int64(float64(p.Base)*p.Jitter)+1))
+}
+
+// 缓存的参数 Key 和 Load 必填
+type StoreOptions[K comparable, V any] struct {
+	Key         func(id K) string                                    // 缓存key 一般使用 StringKey
+	Codec       Codec                                                // 序列化方式 默认 JSONCodec
+	LocalTTL    time.Duration                                        // 本地缓存有效期 应远小于 redis 的有效期 0 表示不使用本地缓存
+	RedisTTL    TTLPolicy                                            // redis 有效期 nil 表示不过期
+	NegativeTTL time.Duration                                        // 不存在的数据的缓存时长 0 表示不缓存
+	NotFound    error                                                // 回源返回该错误表示数据不存在 命中空值缓存时同样返回该错误
+	Load        func(ctx context.Context, id K) (*V, error)          // 回源
+	LoadMany    func(ctx context.Context, ids []K) (map[K]*V, error) // 批量回源 不存在的id不放入结果 未设置时 MGet 逐个调用 Load
+}
+
+// 读穿缓存 依次查询进程内缓存、redis 都未命中时回源并写回两级缓存
+// 本地缓存未开启(config.LocalCache 为空)时只使用 redis
+// 写入和删除会通知其他实例删除各自的本地缓存
+// 同一个key并发未命中时只有一个请求回源 其余请求等待并共享结果
+type Store[K comparable, V any] struct {
+	name   string
+	opts   StoreOptions[K, V]
+	flight flightGroup[V]
+
+	local, redis, db, coalesced levelCounter
+}
+
+// 空值缓存的占位值 各 codec 的编码结果都不会以 \x00nil 开头
+const negativeValue = "\x00nil"
+
+type statsSource interface {
+	stats() map[string]LevelStats
+}
+
+var (
+	statsMu      sync.Mutex
+	statsSources = map[string]statsSource{}
+)
+
+func registerStats(name string, s statsSource) {
+	statsMu.Lock()
+	statsSources[name] = s
+	statsMu.Unlock()
+}
+
+// 创建并注册一个缓存 name 用于统计
+func NewStore[K comparable, V any](name string, opts StoreOptions[K, V]) *Store[K, V] {
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec
+	}
+	s := &Store[K, V]{name: name, opts: opts}
+	registerStats(name, s)
+	return s
+}
+
+// 所有缓存各层级和布隆过滤器的命中统计
+func Stats() map[string]map[string]LevelStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	m := make(map[string]map[string]LevelStats, len(statsSources))
+	for name, s := range statsSources {
+		m[name] = s.stats()
+	}
+	return m
+}
+
+// singleflight 的 hits 为等待并共享结果的请求数 misses 为实际回源的请求数
+func (s *Store[K, V]) stats() map[string]LevelStats {
+	snapshot := func(l *levelCounter) LevelStats {
+		return LevelStats{Hits: l.hits.Load(), Misses: l.misses.Load()}
+	}
+	return map[string]LevelStats{
+		LevelLocal:  snapshot(&s.local),
+		LevelRedis:  snapshot(&s.redis),
+		LevelDB:     snapshot(&s.db),
+		LevelFlight: snapshot(&s.coalesced),
+	}
+}
+
+// 读穿查询 回源的错误原样返回
+func (s *Store[K, V]) Get(ctx context.Context, id K) (*V, error) {
+	key := s.opts.Key(id)
+	if b, ok := s.getLocal(key); ok {
+		if v, err, ok := s.decode(b); ok {
+			s.local.record(true)
+			return v, err
+		}
+	}
+	s.local.record(false)
+
+	b, err := config.RedisClient.Get(ctx, key).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if err == nil {
+		if v, err, ok := s.decode(b); ok {
+			s.redis.record(true)
+			s.setLocal(key, b, s.opts.LocalTTL)
+			return v, err
+		}
+	}
+	s.redis.record(false)
+	return s.fill(ctx, id)
+}
+
+// 未命中时回源 回源不受发起请求的取消影响 避免一个请求取消导致等待的请求全部失败
+func (s *Store[K, V]) fill(ctx context.Context, id K) (*V, error) {
+	v, err, shared := s.flight.do(s.opts.Key(id), func() (*V, error) {
+		return s.refresh(context.WithoutCancel(ctx), id, false)
+	})
+	s.coalesced.record(shared)
+	if v != nil {
+		// 共享的结果复制一份 调用方修改时互不影响
+		cp, cerr := s.clone(v)
+		if cerr != nil {
+			return nil, cerr
+		}
+		v = cp
+	}
+	return v, err
+}
+
+// 深拷贝 proto 消息使用 proto.Clone 其余通过 codec 编解码
+// 直接复制结构体会共享其中的切片、map和指针 proto 消息还包含不能复制的内部状态
+func (s *Store[K, V]) clone(v *V) (*V, error) {
+	if m, ok := any(v).(proto.Message); ok {
+		cp, _ := any(proto.Clone(m)).(*V)
+		return cp, nil
+	}
+	b, err := s.opts.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	cp := new(V)
+	if err := s.opts.Codec.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// 批量查询 结果中不包含不存在的id
+// 本地缓存未命中的id通过一次 pipeline 查询 redis 仍未命中的批量回源
+func (s *Store[K, V]) MGet(ctx context.Context, ids []K) (map[K]*V, error) {
+	res := make(map[K]*V, len(ids))
+	seen := make(map[K]struct{}, len(ids))
+	missing := make([]K, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if b, ok := s.getLocal(s.opts.Key(id)); ok {
+			if v, err, ok := s.decode(b); ok {
+				s.local.record(true)
+				if err == nil {
+					res[id] = v
+				}
+				continue
+			}
+		}
+		s.local.record(false)
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	pipe := config.RedisClient.Pipeline()
+	cmds := make([]*redis.StringCmd, len(missing))
+	for i, id := range missing {
+		cmds[i] = pipe.Get(ctx, s.opts.Key(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	unloaded := missing[:0]
+	for i, id := range missing {
+		b, err := cmds[i].Bytes()
+		if err == nil {
+			if v, err, ok := s.decode(b); ok {
+				s.redis.record(true)
+				s.setLocal(s.opts.Key(id), b, s.opts.LocalTTL)
+				if err == nil {
+					res[id] = v
+				}
+				continue
+			}
+		}
+		s.redis.record(false)
+		unloaded = append(unloaded, id)
+	}
+	if len(unloaded) == 0 {
+		return res, nil
+	}
+
+	if s.opts.LoadMany == nil {
+		for _, id := range unloaded {
+			v, err := s.fill(ctx, id)
+			if s.opts.NotFound != nil && errors.Is(err, s.opts.NotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			res[id] = v
+		}
+		return res, nil
+	}
+	loaded, err := s.opts.LoadMany(ctx, unloaded)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range unloaded {
+		if v, ok := loaded[id]; ok {
+			s.db.record(true)
+			res[id] = v
+		} else {
+			s.db.record(false)
+		}
+	}
+	if err := s.setMany(ctx, unloaded, loaded); err != nil {
+		zap.S().Errorf("Store.setMany name:%v err:%v", s.name, err)
+	}
+	return res, nil
+}
+
+// 批量回源的结果通过一次 pipeline 写回 不存在的id写入空值
+// 未命中时的回填不需要通知其他实例
+func (s *Store[K, V]) setMany(ctx context.Context, ids []K, loaded map[K]*V) error {
+	pipe := config.RedisClient.Pipeline()
+	for _, id := range ids {
+		key := s.opts.Key(id)
+		v, ok := loaded[id]
+		if !ok {
+			if s.opts.NotFound != nil && s.opts.NegativeTTL > 0 {
+				pipe.Set(ctx, key, negativeValue, s.opts.NegativeTTL)
+				s.setLocal(key, []byte(negativeValue), min(s.opts.LocalTTL, s.opts.NegativeTTL))
+			}
+			continue
+		}
+		b, err := s.opts.Codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, key, b, s.redisTTL())
+		s.setLocal(key, b, s.opts.LocalTTL)
+	}
+	if pipe.Len() == 0 {
+		return nil
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 解析缓存的值 ok 为 false 表示数据损坏或格式不符 当作未命中处理
+func (s *Store[K, V]) decode(b []byte) (*V, error, bool) {
+	if string(b) == negativeValue {
+		return nil, s.opts.NotFound, true
+	}
+	v := new(V)
+	if err := s.opts.Codec.Unmarshal(b, v); err != nil {
+		return nil, nil, false
+	}
+	return v, nil, true
+}
+
+// 从数据源重新加载并写入两级缓存 数据修改后调用 会通知其他实例
+func (s *Store[K, V]) Refresh(ctx context.Context, id K) (*V, error) {
+	return s.refresh(ctx, id, true)
+}
+
+// 未命中时的回填不需要通知其他实例
+func (s *Store[K, V]) refresh(ctx context.Context, id K, notify bool) (*V, error) {
+	v, err := s.opts.Load(ctx, id)
+	s.db.record(err == nil)
+	if err != nil {
+		if s.opts.NotFound != nil && s.opts.NegativeTTL > 0 && errors.Is(err, s.opts.NotFound) {
+			if err := s.setNegative(ctx, s.opts.Key(id), notify); err != nil {
+				zap.S().Errorf("Store.setNegative name:%v id:%v err:%v", s.name, id, err)
+			}
+		}
+		return nil, err
+	}
+	if err := s.set(ctx, id, v, notify); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+func (s *Store[K, V]) Set(ctx context.Context, id K, v *V) error {
+	return s.set(ctx, id, v, true)
+}
+
+func (s *Store[K, V]) set(ctx context.Context, id K, v *V, notify bool) error {
+	b, err := s.opts.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	key := s.opts.Key(id)
+	if err := config.RedisClient.Set(ctx, key, b, s.redisTTL()).Err(); err != nil {
+		return err
+	}
+	s.setLocal(key, b, s.opts.LocalTTL)
+	if notify {
+		publishInvalidation(ctx, key)
+	}
+	return nil
+}
+
+// 缓存数据不存在 防止不存在的id每次都查询数据库
+func (s *Store[K, V]) setNegative(ctx context.Context, key string, notify bool) error {
+	if err := config.RedisClient.Set(ctx, key, negativeValue, s.opts.NegativeTTL).Err(); err != nil {
+		return err
+	}
+	s.setLocal(key, []byte(negativeValue), min(s.opts.LocalTTL, s.opts.NegativeTTL))
+	if notify {
+		publishInvalidation(ctx, key)
+	}
+	return nil
+}
+
+func (s *Store[K, V]) redisTTL() time.Duration {
+	if s.opts.RedisTTL == nil {
+		return 0
+	}
+	return s.opts.RedisTTL.TTL()
+}
+
+func (s *Store[K, V]) Delete(ctx context.Context, id K) error {
+	key := s.opts.Key(id)
+	s.deleteLocal(key)
+	if err := config.RedisClient.Del(ctx, key).Err(); err != nil {
+		return err
+	}
+	publishInvalidation(ctx, key)
+	return nil
+}
+
+// 本地缓存的值前8字节为过期时间(纳秒) bigcache 只支持全局的存活时间
+func (s *Store[K, V]) getLocal(key string) ([]byte, bool) {
+	if config.LocalCache == nil || s.opts.LocalTTL <= 0 {
+		return nil, false
+	}
+	b, err := config.LocalCache.Get(key)
+	if err != nil || len(b) < 8 {
+		return nil, false
+	}
+	if time.Now().UnixNano() > int64(binary.BigEndian.Uint64(b)) {
+		return nil, false
+	}
+	return b[8:], true
+}
+
+func (s *Store[K, V]) setLocal(key string, b []byte, ttl time.Duration) {
+	if config.LocalCache == nil || ttl <= 0 {
+		return
+	}
+	entry := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(entry, uint64(time.Now().Add(ttl).UnixNano()))
+	copy(entry[8:], b)
+	if err := config.LocalCache.Set(key, entry); err != nil {
+		zap.S().Errorf("Store.setLocal name:%v key:%v err:%v", s.name, key, err)
+	}
+}
+
+func (s *Store[K, V]) deleteLocal(key string) {
+	if config.LocalCache == nil {
+		return
+	}
+	if err := config.LocalCache.Delete(key); err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		zap.S().Errorf("Store.deleteLocal name:%v key:%v err:%v", s.name, key, err)
+	}
+}
+
+// 合并同一个key的并发回源 同 golang.org/x/sync/singleflight
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+type flightCall[V any] struct {
+	wg  sync.WaitGroup
+	val *V
+	err error
+}
+
+// shared 为 true 表示结果来自其他请求的回源
+func (g *flightGroup[V]) do(key string, fn func() (*V, error)) (v *V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[V]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &flightCall[V]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
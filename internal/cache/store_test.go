@@ -0,0 +1,291 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/testutil"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type item struct {
+	ID        int
+	Name      string
+	Tags      []string
+	UpdatedAt time.Time
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := item{ID: 1, Name: "a", Tags: []string{"x", "y"}, UpdatedAt: time.Now().Truncate(time.Microsecond)}
+	for name, c := range map[string]cache.Codec{"json": cache.JSONCodec, "msgpack": cache.MsgpackCodec} {
+		b, err := c.Marshal(&want)
+		if err != nil {
+			t.Fatalf("%v Marshal err:%v", name, err)
+		}
+		var got item
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%v Unmarshal err:%v", name, err)
+		}
+		if got.ID != want.ID || got.Name != want.Name || !slices.Equal(got.Tags, want.Tags) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+			t.Fatalf("%v got:%+v want:%+v", name, got, want)
+		}
+	}
+
+	msg := wrapperspb.String("hello")
+	b, err := cache.ProtoCodec.Marshal(msg)
+	if err != nil {
+		t.Fatalf("proto Marshal err:%v", err)
+	}
+	got := &wrapperspb.StringValue{}
+	if err := cache.ProtoCodec.Unmarshal(b, got); err != nil {
+		t.Fatalf("proto Unmarshal err:%v", err)
+	}
+	if !proto.Equal(got, msg) {
+		t.Fatalf("proto got:%v want:%v", got, msg)
+	}
+	// 不是 proto 消息时返回错误
+	if _, err := cache.ProtoCodec.Marshal(&want); err == nil {
+		t.Fatalf("proto Marshal 非 proto 消息应失败")
+	}
+}
+
+var errItemNotFound = errors.New("item not found")
+
+// 模拟数据库 记录回源的次数
+type itemSource struct {
+	mu    sync.Mutex
+	items map[int]*item
+	loads []int
+	gate  chan struct{} // 不为空时 load 等待关闭后才返回
+}
+
+func (s *itemSource) load(ctx context.Context, id int) (*item, error) {
+	s.mu.Lock()
+	s.loads = append(s.loads, id)
+	s.mu.Unlock()
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.items[id]
+	if !ok {
+		return nil, errItemNotFound
+	}
+	return v, nil
+}
+
+func (s *itemSource) loadMany(ctx context.Context, ids []int) (map[int]*item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[int]*item{}
+	for _, id := range ids {
+		s.loads = append(s.loads, id)
+		if v, ok := s.items[id]; ok {
+			res[id] = v
+		}
+	}
+	return res, nil
+}
+
+func (s *itemSource) takeLoads() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loads := s.loads
+	s.loads = nil
+	slices.Sort(loads)
+	return loads
+}
+
+func newItemStore(t *testing.T, name string, src *itemSource, many bool) *cache.Store[int, item] {
+	t.Helper()
+	opts := cache.StoreOptions[int, item]{
+		Key:         cache.StringKey[int](name),
+		Codec:       cache.MsgpackCodec,
+		LocalTTL:    time.Minute,
+		RedisTTL:    cache.FixedTTL(time.Hour),
+		NegativeTTL: time.Minute,
+		NotFound:    errItemNotFound,
+		Load:        src.load,
+	}
+	if many {
+		opts.LoadMany = src.loadMany
+	}
+	return cache.NewStore(name, opts)
+}
+
+func TestStoreMGet(t *testing.T) {
+	for _, many := range []bool{true, false} {
+		name := "test_item_load"
+		if many {
+			name = "test_item_load_many"
+		}
+		t.Run(name, func(t *testing.T) {
+			env := testutil.Setup(t, func(c *config.ServerConfig) {
+				c.LocalCacheConf.Enable = true
+			})
+			src := &itemSource{items: map[int]*item{1: {ID: 1, Name: "a"}, 2: {ID: 2, Name: "b"}}}
+			s := newItemStore(t, name, src, many)
+			ctx := context.Background()
+
+			check := func(wantLoads []int) {
+				t.Helper()
+				res, err := s.MGet(ctx, []int{1, 2, 3, 1})
+				if err != nil {
+					t.Fatalf("MGet err:%v", err)
+				}
+				if len(res) != 2 || res[1].Name != "a" || res[2].Name != "b" {
+					t.Fatalf("MGet got:%+v", res)
+				}
+				if loads := src.takeLoads(); !slices.Equal(loads, wantLoads) {
+					t.Fatalf("回源 got:%v want:%v", loads, wantLoads)
+				}
+			}
+			stats := func() map[string]cache.LevelStats {
+				return cache.Stats()[name]
+			}
+
+			// 都未命中 回源后写入两级缓存 不存在的id写入空值
+			check([]int{1, 2, 3})
+			for _, id := range []string{"1", "2", "3"} {
+				if !env.Redis.Exists("s:ginwebproject1:" + name + ":" + id) {
+					t.Fatalf("回源后应写入redis id:%v", id)
+				}
+			}
+			if db := stats()[cache.LevelDB]; db.Hits != 2 || db.Misses != 1 {
+				t.Fatalf("回源统计 got:%+v", db)
+			}
+
+			// 命中本地缓存 包括空值
+			check(nil)
+			if local := stats()[cache.LevelLocal]; local.Hits != 3 {
+				t.Fatalf("本地缓存统计 got:%+v", local)
+			}
+
+			// 本地缓存清空后命中redis
+			if err := config.LocalCache.Reset(); err != nil {
+				t.Fatalf("清空本地缓存失败 err:%v", err)
+			}
+			check(nil)
+			if r := stats()[cache.LevelRedis]; r.Hits != 3 {
+				t.Fatalf("redis统计 got:%+v", r)
+			}
+
+			// 空值过期后重新回源
+			env.Redis.Del("s:ginwebproject1:" + name + ":3")
+			config.LocalCache.Reset()
+			check([]int{3})
+		})
+	}
+}
+
+func TestStoreGetReturnsCopy(t *testing.T) {
+	testutil.Setup(t)
+	orig := &item{ID: 1, Name: "a", Tags: []string{"x"}}
+	src := &itemSource{items: map[int]*item{1: orig}}
+	s := newItemStore(t, "test_item_copy", src, false)
+
+	got, err := s.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Get err:%v", err)
+	}
+	if got == orig || !reflect.DeepEqual(got, orig) {
+		t.Fatalf("回源结果应复制一份 got:%+v", got)
+	}
+	// 修改返回值不影响共享的结果
+	got.Tags[0] = "changed"
+	if orig.Tags[0] != "x" {
+		t.Fatalf("复制后仍共享切片")
+	}
+
+	// proto 消息通过 proto.Clone 复制
+	msg := wrapperspb.String("hello")
+	ps := cache.NewStore("test_proto_copy", cache.StoreOptions[int, wrapperspb.StringValue]{
+		Key:   cache.StringKey[int]("test_proto_copy"),
+		Codec: cache.ProtoCodec,
+		Load: func(ctx context.Context, id int) (*wrapperspb.StringValue, error) {
+			return msg, nil
+		},
+	})
+	pv, err := ps.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("proto Get err:%v", err)
+	}
+	if pv == msg || !proto.Equal(pv, msg) {
+		t.Fatalf("proto 回源结果应复制一份 got:%v", pv)
+	}
+}
+
+func TestStoreGetCoalesces(t *testing.T) {
+	testutil.Setup(t)
+	src := &itemSource{items: map[int]*item{1: {ID: 1, Name: "a"}}, gate: make(chan struct{})}
+	s := newItemStore(t, "test_item_flight", src, false)
+
+	// 回源完成前的并发请求都未命中缓存
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]*item, n)
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = s.Get(context.Background(), 1)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(src.gate)
+	wg.Wait()
+
+	if loads := src.takeLoads(); !slices.Equal(loads, []int{1}) {
+		t.Fatalf("并发未命中应只回源一次 got:%v", loads)
+	}
+	for i := range n {
+		if errs[i] != nil || results[i] == nil || results[i].Name != "a" {
+			t.Fatalf("第%v个请求 got:%+v err:%v", i, results[i], errs[i])
+		}
+	}
+	if f := cache.Stats()["test_item_flight"][cache.LevelFlight]; f.Misses != 1 {
+		t.Fatalf("singleflight统计 got:%+v", f)
+	}
+}
+
+func TestStoreNegativeCache(t *testing.T) {
+	env := testutil.Setup(t)
+	src := &itemSource{items: map[int]*item{}}
+	s := newItemStore(t, "test_item_negative", src, false)
+	ctx := context.Background()
+	key := "s:ginwebproject1:test_item_negative:7"
+
+	get := func(wantLoads []int) {
+		t.Helper()
+		if _, err := s.Get(ctx, 7); !errors.Is(err, errItemNotFound) {
+			t.Fatalf("不存在的数据应返回 NotFound err:%v", err)
+		}
+		if loads := src.takeLoads(); !slices.Equal(loads, wantLoads) {
+			t.Fatalf("回源 got:%v want:%v", loads, wantLoads)
+		}
+	}
+
+	// 不存在的结果按 NegativeTTL 缓存为空值
+	get([]int{7})
+	if v, _ := env.Redis.Get(key); v != "\x00nil" {
+		t.Fatalf("应缓存空值 got:%q", v)
+	}
+	if ttl := env.Redis.TTL(key); ttl != time.Minute {
+		t.Fatalf("空值的有效期 got:%v", ttl)
+	}
+	// 有效期内不再回源
+	get(nil)
+	// 过期后重新回源
+	env.Redis.FastForward(time.Minute)
+	get([]int{7})
+}
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// refresh token 不存在、已过期或所属的token家族已被吊销
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid")
+	// 已经轮换过的 refresh token 被再次使用 说明可能已泄露
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// refresh token 的服务端记录
+// Family 为同一次登录派生出来的所有 refresh token 共享的家族id
+type RefreshToken struct {
+	UserID   uint
+	Username string
+	Family   string
+	MFA      bool // 登录时是否通过了两步验证 刷新后保持不变
+}
+
+// hs:ginwebproject1:refresh:<token摘要>  保存refresh token记录
+func refreshTokenKey(hash string) string {
+	return fmt.Sprintf("hs:ginwebproject1:refresh:%v", hash)
+}
+
+// s:ginwebproject1:refresh_family:<family>  家族存活标记 删除即吊销整个家族
+func refreshFamilyKey(family string) string {
+	return fmt.Sprintf("s:ginwebproject1:refresh_family:%v", family)
+}
+
+func SaveRefreshToken(ctx context.Context, token string, rt RefreshToken, ttl time.Duration) error {
+	key := refreshTokenKey(pkg.HashToken(token))
+	// 使用 pipeline 一次往返写入记录和家族标记
+	pipe := config.RedisClient.TxPipeline()
+	pipe.HSet(ctx, key, map[string]any{
+		"uid":      rt.UserID,
+		"username": rt.Username,
+		"family":   rt.Family,
+		"mfa":      rt.MFA,
+		"used":     0,
+	})
+	pipe.Expire(ctx, key, ttl)
+	// 每次轮换都续期家族标记
+	pipe.Set(ctx, refreshFamilyKey(rt.Family), 1, ttl)
+	// 记录用户名下的家族 便于一次性吊销
+	pipe.SAdd(ctx, userRefreshFamilyKey(rt.UserID), rt.Family)
+	pipe.Expire(ctx, userRefreshFamilyKey(rt.UserID), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 读取记录并累加使用次数 只在记录存在时累加 避免过期或吊销后重新创建出没有ttl的key
+// 返回 uid username family mfa 和累加后的次数 记录不存在时返回 nil
+var useRefreshScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local used = redis.call('HINCRBY', KEYS[1], 'used', 1)
+local v = redis.call('HMGET', KEYS[1], 'uid', 'username', 'family', 'mfa')
+return {v[1], v[2], v[3], v[4], used}
+`)
+
+// 消费一个 refresh token 每个token只能成功使用一次
+// 若已使用过的token被再次提交 则吊销整个家族并返回 ErrRefreshTokenReused
+func UseRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	key := refreshTokenKey(pkg.HashToken(token))
+	// 读取和累加在同一个脚本中 并发刷新时只有一个请求能拿到 1
+	result, err := useRefreshScript.Run(ctx, config.RedisClient, []string{key}).Slice()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 5 {
+		return nil, ErrRefreshTokenInvalid
+	}
+	fields := make([]string, 4)
+	for i := range fields {
+		fields[i], _ = result[i].(string)
+	}
+	uid, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	rt := &RefreshToken{
+		UserID:   uint(uid),
+		Username: fields[1],
+		Family:   fields[2],
+		MFA:      fields[3] == "1",
+	}
+	used, _ := result[4].(int64)
+	if used > 1 {
+		if err := RevokeRefreshFamily(ctx, rt.Family); err != nil {
+			return nil, err
+		}
+		return rt, ErrRefreshTokenReused
+	}
+	// 家族已被吊销
+	n, err := config.RedisClient.Exists(ctx, refreshFamilyKey(rt.Family)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return rt, nil
+}
+
+// 吊销整个家族 对应的会话同时结束
+func RevokeRefreshFamily(ctx context.Context, family string) error {
+	_, err := config.RedisClient.Del(ctx, refreshFamilyKey(family), sessionKey(family)).Result()
+	return err
+}
+
+// se:ginwebproject1:user_refresh_family:<uid>  用户名下所有的token家族
+func userRefreshFamilyKey(userId uint) string {
+	return fmt.Sprintf("se:ginwebproject1:user_refresh_family:%v", userId)
+}
+
+// s:ginwebproject1:jwt_deny:<jti>  已注销的access token
+func jwtDenyKey(jti string) string {
+	return fmt.Sprintf("s:ginwebproject1:jwt_deny:%v", jti)
+}
+
+// s:ginwebproject1:revoke_before:<uid>  该时间点(毫秒)及之前签发的access token全部失效
+func revokeBeforeKey(userId uint) string {
+	return fmt.Sprintf("s:ginwebproject1:revoke_before:%v", userId)
+}
+
+// 吊销单个 refresh token 所在的家族 用于登出
+func RevokeRefreshToken(ctx context.Context, token string) error {
+	family, err := config.RedisClient.HGet(ctx, refreshTokenKey(pkg.HashToken(token)), "family").Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return RevokeRefreshFamily(ctx, family)
+}
+
+// 将access token加入黑名单 ttl为token剩余有效期 过期后自然清理
+func DenyAccessToken(ctx context.Context, jti string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := config.RedisClient.Set(ctx, jwtDenyKey(jti), 1, ttl).Result()
+	return err
+}
+
+// 吊销用户的全部令牌 删除账号、修改密码时调用
+func RevokeUserTokens(ctx context.Context, userId uint) error {
+	families, err := config.RedisClient.SMembers(ctx, userRefreshFamilyKey(userId)).Result()
+	if err != nil {
+		return err
+	}
+	pipe := config.RedisClient.TxPipeline()
+	for _, family := range families {
+		pipe.Del(ctx, refreshFamilyKey(family), sessionKey(family))
+	}
+	pipe.Del(ctx, userRefreshFamilyKey(userId))
+	// 只需保留到最后一个已签发的access token过期即可 包括签发给接入应用的访问令牌
+	ttl := max(config.Config.JWTConf.AccessExpire, config.Config.OAuthConf.AccessExpire)
+	pipe.Set(ctx, revokeBeforeKey(userId), time.Now().UnixMilli(), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// 检查access token是否已被吊销
+// iatMs 为毫秒签发时间 不晚于用户 revoke_before 的token视为失效
+// sid 为token所属会话 会话已结束时token失效 会话仍存在时只检查黑名单
+// sid 为空表示旧版本签发的token或接入应用的访问令牌 按 revoke_before 判断
+func IsAccessTokenRevoked(ctx context.Context, jti string, userId uint, iatMs int64, sid string) (bool, error) {
+	pipe := config.RedisClient.Pipeline()
+	denied := pipe.Exists(ctx, jwtDenyKey(jti))
+	before := pipe.Get(ctx, revokeBeforeKey(userId))
+	var session *redis.IntCmd
+	if sid != "" {
+		session = pipe.Exists(ctx, refreshFamilyKey(sid))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if denied.Val() > 0 {
+		return true, nil
+	}
+	if session != nil {
+		// 吊销时删除了该用户的所有会话 仍然存在的会话都是吊销之后登录的
+		// 不再比较 revoke_before 吊销后立即签发的新令牌即使在同一毫秒内也可用
+		return session.Val() == 0, nil
+	}
+	if before.Err() == nil {
+		ts, err := before.Int64()
+		if err != nil {
+			return false, err
+		}
+		// 旧版本按秒记录
+		if ts < 1e12 {
+			ts *= 1000
+		}
+		// 同一毫秒内签发的token同样失效
+		if iatMs <= ts {
+			return true, nil
+		}
+	}
+	return false, nil
+}
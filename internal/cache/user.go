@@ -2,14 +2,12 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"ginwebproject1/internal/config"
 	"ginwebproject1/internal/model"
 	"strconv"
+	"sync"
 
-	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
@@ -22,68 +20,73 @@ import (
 // bf代表布隆过滤器
 // hy代表hyperloglog
 // b代表bitmap
+// ch代表pub/sub频道
 
+// 沿用最初的key格式 s:ginwebproject1:<id> 与已有缓存和其他实例的失效通知保持一致
+// 新的数据类型使用 StringKey 生成带类型名的key
 func userInfoKey(id string) string {
 	return fmt.Sprintf("s:ginwebproject1:%v", id)
 }
 
-func GetUserInfo(ctx context.Context, userId string) (*model.User, error) {
-	// 从redis中查询用户信息
-	result, err := config.RedisClient.Get(ctx, userInfoKey(userId)).Result()
-	// 查询错误
-	if err != nil {
+// 用户信息的缓存 第一次使用时按配置创建
+var userInfoCache = sync.OnceValue(func() *Store[string, model.User] {
+	return NewStore("user_info", StoreOptions[string, model.User]{
+		Key:         userInfoKey,
+		Codec:       JSONCodec,
+		LocalTTL:    config.Config.LocalCacheConf.UserTTL,
+		RedisTTL:    JitterTTL{Base: config.Config.CacheConf.UserTTL, Jitter: config.Config.CacheConf.Jitter},
+		NegativeTTL: config.Config.CacheConf.NegativeTTL,
+		NotFound:    gorm.ErrRecordNotFound,
+		Load:        loadUserInfo,
+		LoadMany:    loadUsersInfo,
+	})
+})
+
+// 从数据库查询用户 不存在时返回 gorm.ErrRecordNotFound
+func loadUserInfo(ctx context.Context, userId string) (*model.User, error) {
+	user := model.User{}
+	tx := config.DB.WithContext(ctx).Where("id=?", userId).First(&user)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &user, nil
+}
+
+func loadUsersInfo(ctx context.Context, userIds []string) (map[string]*model.User, error) {
+	var users []model.User
+	if err := config.DB.WithContext(ctx).Where("id IN ?", userIds).Find(&users).Error; err != nil {
 		return nil, err
 	}
-	// 查询为空
-	if result == "" {
-		return nil, redis.Nil
+	m := make(map[string]*model.User, len(users))
+	for i := range users {
+		m[strconv.Itoa(int(users[i].ID))] = &users[i]
 	}
-	// 将查询到的信息反序列化到结构体中
-	var user model.User
-	err = json.Unmarshal([]byte(result), &user)
-	if err != nil {
-		return nil, err
+	return m, nil
+}
+
+// 依次查询布隆过滤器、本地缓存、redis、数据库 用户不存在时返回 gorm.ErrRecordNotFound
+// 不存在的用户会短暂缓存 新建用户后需要调用 DeleteUserInfo
+func GetUserInfo(ctx context.Context, userId string) (*model.User, error) {
+	if !BloomUserIDMayExist(ctx, userId) {
+		return nil, gorm.ErrRecordNotFound
 	}
-	return &user, nil
+	return userInfoCache().Get(ctx, userId)
+}
+
+// 批量查询用户信息 结果中不包含不存在的用户
+func GetUsersInfo(ctx context.Context, userIds []string) (map[string]*model.User, error) {
+	return userInfoCache().MGet(ctx, BloomFilterUserIDs(ctx, userIds))
 }
 
 func SetUserInfo(ctx context.Context, user model.User) error {
-	// 序列化为json
-	marshal, err := json.Marshal(user)
-	if err != nil {
-		return err
-	}
-	// 0：代表 不过期（永久缓存）
-	_, err = config.RedisClient.Set(ctx, userInfoKey(strconv.Itoa(int(user.ID))), marshal, 0).Result()
-	if err != nil {
-		return err
-	}
-	return nil
+	return userInfoCache().Set(ctx, strconv.Itoa(int(user.ID)), &user)
 }
 
+// 从数据库重新加载并写入缓存 用户信息修改后调用
 func RefreshUserInfo(ctx context.Context, userId string) (*model.User, error) {
-	user := model.User{}
-	tx := config.DB.Where("id=?", userId).First(&user)
-	// 处理查询错误
-	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-		return &user, tx.Error
-	}
-	// 查询为空
-	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-		return &user, nil
-	}
-	// 写入到 redis
-	err := SetUserInfo(ctx, user)
-	if err != nil {
-		return &user, err
-	}
-	return &user, nil
+	return userInfoCache().Refresh(ctx, userId)
 }
 
 func DeleteUserInfo(ctx context.Context, userId string) error {
-	_, err := config.RedisClient.Del(ctx, userInfoKey(userId)).Result()
-	if err != nil {
-		return err
-	}
-	return err
+	return userInfoCache().Delete(ctx, userId)
 }
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"strconv"
+	"time"
+)
+
+// s:ginwebproject1:email_verify:<token摘要>  邮箱验证token 值为用户id
+func emailVerifyKey(hash string) string {
+	return fmt.Sprintf("s:ginwebproject1:email_verify:%v", hash)
+}
+
+// s:ginwebproject1:email_verify_throttle:<uid>  重发验证邮件的冷却标记
+func emailVerifyThrottleKey(userId uint) string {
+	return fmt.Sprintf("s:ginwebproject1:email_verify_throttle:%v", userId)
+}
+
+func SaveEmailVerifyToken(ctx context.Context, token string, userId uint, ttl time.Duration) error {
+	_, err := config.RedisClient.Set(ctx, emailVerifyKey(pkg.HashToken(token)), userId, ttl).Result()
+	return err
+}
+
+// 取出并删除邮箱验证token token不存在或已过期时返回 redis.Nil
+func TakeEmailVerifyToken(ctx context.Context, token string) (uint, error) {
+	result, err := config.RedisClient.GetDel(ctx, emailVerifyKey(pkg.HashToken(token))).Result()
+	if err != nil {
+		return 0, err
+	}
+	userId, err := strconv.ParseUint(result, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(userId), nil
+}
+
+// 尝试占用发送验证邮件的冷却窗口 返回false表示仍在冷却中
+func AcquireEmailVerifySend(ctx context.Context, userId uint, interval time.Duration) (bool, error) {
+	return config.RedisClient.SetNX(ctx, emailVerifyThrottleKey(userId), 1, interval).Result()
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/allegro/bigcache/v3"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
@@ -10,13 +12,148 @@ import (
 // “tag  利用viper解析yaml mapstructure:"name"应config.yaml的name
 // json:"name"是结构体需要序列化成json时，这个字段会以name展示
 type ServerConfig struct {
-	Name      string      `mapstructure:"name" json:"name"`   // 服务名称
-	Host      string      `mapstructure:"host" json:"host"`   // 主机地址
-	Port      int         `mapstructure:"port" json:"port"`   // 启动端口
-	Mode      string      `mapstructure:"mode" json:"mode"`   // 启动模式
-	RedisConf redisConfig `mapstructure:"redis" json:"redis"` // Redis配置
-	MysqlConf mysqlConfig `mapstructure:"mysql" json:"mysql"` // Mysql配置
-	LogConf   logsConfig  `mapstructure:"logs" json:"logs"`   // 日志配置
+	Name           string           `mapstructure:"name" json:"name"`               // 服务名称
+	Host           string           `mapstructure:"host" json:"host"`               // 主机地址
+	Port           int              `mapstructure:"port" json:"port"`               // 启动端口
+	Mode           string           `mapstructure:"mode" json:"mode"`               // 启动模式
+	RedisConf      redisConfig      `mapstructure:"redis" json:"redis"`             // Redis配置
+	MysqlConf      mysqlConfig      `mapstructure:"mysql" json:"mysql"`             // Mysql配置
+	LogConf        logsConfig       `mapstructure:"logs" json:"logs"`               // 日志配置
+	JWTConf        jwtConfig        `mapstructure:"jwt" json:"jwt"`                 // JWT配置
+	RBACConf       rbacConfig       `mapstructure:"rbac" json:"rbac"`               // 权限配置
+	MailConf       mailConfig       `mapstructure:"mail" json:"mail"`               // 邮件配置
+	PwdConf        pwdConfig        `mapstructure:"password" json:"password"`       // 密码配置
+	RegConf        registerConfig   `mapstructure:"register" json:"register"`       // 注册配置
+	LoginGuardConf loginGuardConfig `mapstructure:"login_guard" json:"login_guard"` // 登录防爆破配置
+	RateLimitConf  rateLimitConfig  `mapstructure:"rate_limit" json:"rate_limit"`   // 限流配置
+	MFAConf        mfaConfig        `mapstructure:"mfa" json:"mfa"`                 // 两步验证配置
+	APIKeyConf     apiKeyConfig     `mapstructure:"api_key" json:"api_key"`         // API key配置
+	OIDCConf       oidcConfig       `mapstructure:"oidc" json:"oidc"`               // 第三方登录配置
+	OAuthConf      oauthConfig      `mapstructure:"oauth" json:"oauth"`             // 作为授权服务器的配置
+	LocalCacheConf localCacheConfig `mapstructure:"local_cache" json:"local_cache"` // 进程内缓存配置
+	CacheConf      cacheConfig      `mapstructure:"cache" json:"cache"`             // redis缓存配置
+	BloomConf      bloomConfig      `mapstructure:"bloom" json:"bloom"`             // 布隆过滤器配置
+}
+
+type bloomConfig struct {
+	Enable        bool    `mapstructure:"enable" json:"enable"`                 // 是否开启 关闭时所有查询按可能存在处理
+	ExpectedItems int     `mapstructure:"expected_items" json:"expected_items"` // 预期元素数量 决定位数组大小
+	FalsePositive float64 `mapstructure:"false_positive" json:"false_positive"` // 期望误判率
+	RebuildAfter  int64   `mapstructure:"rebuild_after" json:"rebuild_after"`   // 删除的元素累计达到该数量后重建 0表示不自动重建
+}
+
+type cacheConfig struct {
+	UserTTL     time.Duration `mapstructure:"user_ttl" json:"user_ttl"`         // 用户信息在redis中的有效期
+	Jitter      float64       `mapstructure:"jitter" json:"jitter"`             // 有效期随机增加的比例 避免同时过期
+	NegativeTTL time.Duration `mapstructure:"negative_ttl" json:"negative_ttl"` // 不存在的数据的缓存时长 0表示不缓存
+}
+
+type localCacheConfig struct {
+	Enable     bool          `mapstructure:"enable" json:"enable"`           // 是否开启进程内缓存 关闭时只使用redis
+	LifeWindow time.Duration `mapstructure:"life_window" json:"life_window"` // 条目最长存活时间 各类数据的有效期不能超过该值
+	MaxSize    int           `mapstructure:"max_size" json:"max_size"`       // 最大占用内存 MB 0表示不限制
+	UserTTL    time.Duration `mapstructure:"user_ttl" json:"user_ttl"`       // 用户信息在本地缓存的有效期
+}
+
+type oauthConfig struct {
+	Issuer        string        `mapstructure:"issuer" json:"issuer"`                 // 对外地址 发现文档和访问令牌的 iss
+	Audience      string        `mapstructure:"audience" json:"audience"`             // 访问令牌的 aud 必须与 jwt.audience 不同
+	AccessExpire  time.Duration `mapstructure:"access_expire" json:"access_expire"`   // 访问令牌有效期
+	CodeExpire    time.Duration `mapstructure:"code_expire" json:"code_expire"`       // 授权码有效期
+	RequestExpire time.Duration `mapstructure:"request_expire" json:"request_expire"` // 跳转到授权确认页后完成确认的时限
+	ConsentURL    string        `mapstructure:"consent_url" json:"consent_url"`       // 授权确认页地址 请求id拼接在query中
+}
+
+type oidcConfig struct {
+	StateExpire time.Duration                 `mapstructure:"state_expire" json:"state_expire"` // 跳转到提供方后完成登录的时限
+	Fake        bool                          `mapstructure:"fake" json:"fake"`                 // 启用内置的测试提供方 使用 providers.fake 的配置
+	Providers   map[string]OIDCProviderConfig `mapstructure:"providers" json:"providers"`       // 按名称配置的提供方
+}
+
+// 单个提供方的配置 测试中需要直接构造 因此导出
+type OIDCProviderConfig struct {
+	Issuer       string   `mapstructure:"issuer" json:"issuer"`             // 提供方地址 用于获取 /.well-known/openid-configuration
+	ClientID     string   `mapstructure:"client_id" json:"client_id"`       // 在提供方注册的客户端id
+	ClientSecret string   `mapstructure:"client_secret" json:"-"`           // 客户端密钥
+	RedirectURL  string   `mapstructure:"redirect_url" json:"redirect_url"` // 回调地址 /oauth/<name>/callback
+	Scopes       []string `mapstructure:"scopes" json:"scopes"`             // 默认 openid email profile
+}
+
+type apiKeyConfig struct {
+	DefaultTTL time.Duration `mapstructure:"default_ttl" json:"default_ttl"`   // 未指定过期时间时的有效期
+	MaxTTL     time.Duration `mapstructure:"max_ttl" json:"max_ttl"`           // 最长有效期
+	MaxPerUser int64         `mapstructure:"max_per_user" json:"max_per_user"` // 每个用户最多的有效key数量
+}
+
+type mfaConfig struct {
+	Issuer          string        `mapstructure:"issuer" json:"issuer"`                       // 验证器App中显示的服务名
+	Skew            int           `mapstructure:"skew" json:"skew"`                           // 允许前后误差的时间步数 每步30秒
+	PendingExpire   time.Duration `mapstructure:"pending_expire" json:"pending_expire"`       // 登录第二步的有效期
+	MaxAttempts     int64         `mapstructure:"max_attempts" json:"max_attempts"`           // 第二步验证码最多错误次数 超过需重新登录
+	RecoveryCodes   int           `mapstructure:"recovery_codes" json:"recovery_codes"`       // 每次生成的恢复码数量
+	RequireForAdmin bool          `mapstructure:"require_for_admin" json:"require_for_admin"` // 管理后台接口要求通过两步验证登录
+}
+
+type rateLimitConfig struct {
+	Enable bool                     `mapstructure:"enable" json:"enable"` // 是否开启限流
+	Rules  map[string]RateLimitRule `mapstructure:"rules" json:"rules"`   // 按路由组命名的限流规则
+}
+
+type RateLimitRule struct {
+	Algorithm string        `mapstructure:"algorithm" json:"algorithm"` // sliding_window、token_bucket
+	Key       string        `mapstructure:"key" json:"key"`             // 计数维度 ip、user、route、ip_route
+	Limit     int64         `mapstructure:"limit" json:"limit"`         // 每个窗口允许的请求数
+	Window    time.Duration `mapstructure:"window" json:"window"`       // 窗口时长
+	Burst     int64         `mapstructure:"burst" json:"burst"`         // 令牌桶容量 默认等于limit
+}
+
+type loginGuardConfig struct {
+	MaxFailures   int64         `mapstructure:"max_failures" json:"max_failures"`       // 同一用户名连续失败次数达到后锁定
+	IPMaxFailures int64         `mapstructure:"ip_max_failures" json:"ip_max_failures"` // 同一ip连续失败次数达到后锁定
+	Lockout       time.Duration `mapstructure:"lockout" json:"lockout"`                 // 锁定时长 同时也是失败计数的统计窗口
+	BackoffAfter  int64         `mapstructure:"backoff_after" json:"backoff_after"`     // 超过该次数后开始指数退避
+	BackoffBase   time.Duration `mapstructure:"backoff_base" json:"backoff_base"`       // 退避初始时长
+	BackoffMax    time.Duration `mapstructure:"backoff_max" json:"backoff_max"`         // 退避最大时长
+}
+
+type mailConfig struct {
+	Driver string     `mapstructure:"driver" json:"driver"` // log、file、smtp
+	From   string     `mapstructure:"from" json:"from"`     // 发件人
+	Outbox string     `mapstructure:"outbox" json:"outbox"` // file模式下邮件保存目录
+	SMTP   smtpConfig `mapstructure:"smtp" json:"smtp"`     // smtp模式配置
+}
+
+type smtpConfig struct {
+	Host     string `mapstructure:"host" json:"host"`
+	Port     int    `mapstructure:"port" json:"port"`
+	Username string `mapstructure:"username" json:"username"`
+	Password string `mapstructure:"password" json:"-"`
+}
+
+type registerConfig struct {
+	RequireVerification bool          `mapstructure:"require_verification" json:"require_verification"` // 未验证邮箱是否禁止登录
+	VerifyExpire        time.Duration `mapstructure:"verify_expire" json:"verify_expire"`               // 验证链接有效期
+	VerifyURL           string        `mapstructure:"verify_url" json:"verify_url"`                     // 验证页面地址 token拼接在query中
+	ResendInterval      time.Duration `mapstructure:"resend_interval" json:"resend_interval"`           // 重发验证邮件的最小间隔
+}
+
+type pwdConfig struct {
+	ResetExpire time.Duration `mapstructure:"reset_expire" json:"reset_expire"` // 重置链接有效期
+	ResetURL    string        `mapstructure:"reset_url" json:"reset_url"`       // 重置页面地址 token拼接在query中
+	Algorithm   string        `mapstructure:"algorithm" json:"algorithm"`       // 新密码使用的哈希算法 argon2id、bcrypt
+	Pepper      string        `mapstructure:"pepper" json:"-"`                  // 服务端密钥 修改后已有的argon2id哈希全部失效
+	Argon2      argon2Config  `mapstructure:"argon2" json:"argon2"`             // argon2id参数
+	BcryptCost  int           `mapstructure:"bcrypt_cost" json:"bcrypt_cost"`   // bcrypt cost
+}
+
+type argon2Config struct {
+	Memory      uint32 `mapstructure:"memory" json:"memory"`           // 内存 KiB
+	Iterations  uint32 `mapstructure:"iterations" json:"iterations"`   // 迭代次数
+	Parallelism uint8  `mapstructure:"parallelism" json:"parallelism"` // 并行度
+}
+
+type rbacConfig struct {
+	Admins []string `mapstructure:"admins" json:"admins"` // 启动时自动分配管理员角色的用户名
 }
 
 type redisConfig struct {
@@ -42,6 +179,39 @@ type mysqlConfig struct {
 	Password string `mapstructure:"password" json:"password"` // Mysql密码
 }
 
+type jwtConfig struct {
+	AccessExpire  time.Duration  `mapstructure:"access_expire" json:"access_expire"`   // access token有效期 如15m
+	RefreshExpire time.Duration  `mapstructure:"refresh_expire" json:"refresh_expire"` // refresh token有效期 如168h
+	Issuer        string         `mapstructure:"issuer" json:"issuer"`                 // 签发方 iss
+	Audience      string         `mapstructure:"audience" json:"audience"`             // 受众 aud
+	ClockSkew     time.Duration  `mapstructure:"clock_skew" json:"clock_skew"`         // 允许的时钟误差
+	ActiveKid     string         `mapstructure:"active_kid" json:"active_kid"`         // 当前用于签名的密钥kid
+	Keys          []jwtKeyConfig `mapstructure:"keys" json:"keys"`                     // 密钥环
+	Watch         bool           `mapstructure:"watch" json:"watch"`                   // 是否监听密钥文件变化并热加载
+	Cookie        cookieConfig   `mapstructure:"cookie" json:"cookie"`                 // cookie会话配置
+}
+
+// 开启后 Login 会把token写入 HttpOnly cookie 并使用双重提交的 CSRF token
+type cookieConfig struct {
+	Enable      bool   `mapstructure:"enable" json:"enable"`             // 是否开启cookie模式
+	Name        string `mapstructure:"name" json:"name"`                 // access token cookie名
+	RefreshName string `mapstructure:"refresh_name" json:"refresh_name"` // refresh token cookie名
+	Domain      string `mapstructure:"domain" json:"domain"`             // cookie域名
+	Secure      bool   `mapstructure:"secure" json:"secure"`             // 仅https发送
+	SameSite    string `mapstructure:"same_site" json:"same_site"`       // lax、strict、none
+	CSRFCookie  string `mapstructure:"csrf_cookie" json:"csrf_cookie"`   // CSRF token cookie名
+	CSRFHeader  string `mapstructure:"csrf_header" json:"csrf_header"`   // CSRF token 请求头
+}
+
+// 轮换时先加入新key并切换active_kid 旧key保留到retire_at后删除
+type jwtKeyConfig struct {
+	Kid        string `mapstructure:"kid" json:"kid"`               // 密钥标识 写入token header
+	Alg        string `mapstructure:"alg" json:"alg"`               // 签名算法 RS256/ES256/EdDSA 默认RS256
+	PrivateKey string `mapstructure:"private_key" json:"-"`         // 私钥路径 只在活动key上必填
+	PublicKey  string `mapstructure:"public_key" json:"public_key"` // 公钥路径
+	RetireAt   string `mapstructure:"retire_at" json:"retire_at"`   // 退役时间 RFC3339格式 为空表示不退役
+}
+
 var Config ServerConfig
 var DB *gorm.DB
 var RedisClient redis.UniversalClient
@@ -0,0 +1,318 @@
+package logic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/pkg"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 查询用户并预加载角色和权限
+func loadUserWithRoles(userId uint) (*model.User, error) {
+	user := model.User{}
+	tx := config.DB.Preload("Roles.Permissions").First(&user, userId)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &user, nil
+}
+
+// 列出所有角色及其权限
+func ListRoles(c *gin.Context) {
+	var roles []model.Role
+	tx := config.DB.Preload("Permissions").Find(&roles)
+	if tx.Error != nil {
+		zap.S().Errorf("ListRoles err:%v", tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(roles))
+}
+
+// 设置用户的角色 会覆盖原有角色
+func SetUserRoles(c *gin.Context) {
+	var r api.SetRolesRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	user := model.User{}
+	tx := config.DB.First(&user, userId)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if tx.Error != nil {
+		zap.S().Errorf("SetUserRoles query user userId:%v err:%v", userId, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 去掉重复的角色名 否则与查询到的数量对不上
+	r.Roles = slices.Compact(slices.Sorted(slices.Values(r.Roles)))
+	var roles []model.Role
+	if len(r.Roles) > 0 {
+		tx = config.DB.Where("name IN ?", r.Roles).Find(&roles)
+		if tx.Error != nil {
+			zap.S().Errorf("SetUserRoles query roles:%v err:%v", r.Roles, tx.Error)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+	}
+	// 存在未知的角色名
+	if len(roles) != len(r.Roles) {
+		c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "角色不存在"))
+		return
+	}
+	if err := config.DB.Model(&user).Association("Roles").Replace(roles); err != nil {
+		zap.S().Errorf("SetUserRoles replace userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 权限保存在token中 吊销旧token使变更立即生效
+	if err := cache.RevokeUserTokens(c.Request.Context(), user.ID); err != nil {
+		zap.S().Errorf("SetUserRoles.RevokeUserTokens userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 游标 记录上一页最后一条的排序字段值和id
+type userCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(cur userCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur userCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// 排序字段在游标中的字符串形式
+func cursorValue(u *model.User, sort string) string {
+	switch sort {
+	case "created_at":
+		return u.CreatedAt.Format(time.RFC3339Nano)
+	case "username":
+		return u.Username
+	}
+	return strconv.FormatUint(uint64(u.ID), 10)
+}
+
+// 转义 LIKE 中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func toUserItem(u *model.User) api.UserItem {
+	roles, _ := u.RoleNames()
+	if roles == nil {
+		roles = []string{}
+	}
+	return api.UserItem{
+		ID:        u.ID,
+		Username:  u.Username,
+		Email:     u.Email,
+		Status:    u.Status,
+		Roles:     roles,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// 用户列表 支持游标分页、过滤、排序和模糊搜索
+func ListUsers(c *gin.Context) {
+	var r api.ListUsersRequest
+	if err := c.ShouldBindQuery(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	if r.Limit == 0 {
+		r.Limit = 20
+	}
+	if r.Sort == "" {
+		r.Sort = "id"
+	}
+	if r.Order == "" {
+		r.Order = "desc"
+	}
+
+	tx := config.DB.Model(&model.User{}).Preload("Roles")
+	if r.Q != "" {
+		like := "%" + escapeLike(r.Q) + "%"
+		tx = tx.Where("username LIKE ? OR email LIKE ?", like, like)
+	}
+	if r.EmailDomain != "" {
+		tx = tx.Where("email LIKE ?", "%@"+escapeLike(strings.TrimPrefix(r.EmailDomain, "@")))
+	}
+	if r.Status != "" {
+		tx = tx.Where("status = ?", r.Status)
+	}
+	if !r.CreatedFrom.IsZero() {
+		tx = tx.Where("created_at >= ?", r.CreatedFrom)
+	}
+	if !r.CreatedTo.IsZero() {
+		tx = tx.Where("created_at < ?", r.CreatedTo.AddDate(0, 0, 1))
+	}
+
+	// 按 (排序字段, id) 做键集分页 翻页时结果稳定
+	cmp := "<"
+	if r.Order == "asc" {
+		cmp = ">"
+	}
+	if r.Cursor != "" {
+		cur, err := decodeCursor(r.Cursor)
+		if err != nil {
+			c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "cursor无效"))
+			return
+		}
+		var value any = cur.Value
+		if r.Sort == "created_at" {
+			value, err = time.Parse(time.RFC3339Nano, cur.Value)
+		} else if r.Sort == "id" {
+			value, err = strconv.ParseUint(cur.Value, 10, 64)
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "cursor无效"))
+			return
+		}
+		if r.Sort == "id" {
+			tx = tx.Where("id "+cmp+" ?", value)
+		} else {
+			tx = tx.Where("("+r.Sort+" "+cmp+" ?) OR ("+r.Sort+" = ? AND id "+cmp+" ?)", value, value, cur.ID)
+		}
+	}
+	order := r.Sort + " " + r.Order
+	if r.Sort != "id" {
+		order += ", id " + r.Order
+	}
+
+	// 多查一条用于判断是否还有下一页
+	var users []model.User
+	if err := tx.Order(order).Limit(r.Limit + 1).Find(&users).Error; err != nil {
+		zap.S().Errorf("ListUsers query:%+v err:%v", r, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	resp := api.UserListResponse{
+		List:   make([]api.UserItem, 0, len(users)),
+		Paging: api.Paging{Limit: r.Limit},
+	}
+	if len(users) > r.Limit {
+		users = users[:r.Limit]
+		last := &users[len(users)-1]
+		resp.Paging.HasMore = true
+		resp.Paging.NextCursor = encodeCursor(userCursor{Value: cursorValue(last, r.Sort), ID: last.ID})
+	}
+	for i := range users {
+		resp.List = append(resp.List, toUserItem(&users[i]))
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(resp))
+}
+
+// 根据id查询任意用户
+func GetUser(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	user, err := loadUserWithRoles(uint(userId))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("GetUser userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(toUserItem(user)))
+}
+
+// 禁用账号 同时吊销该用户的全部令牌
+func DisableUser(c *gin.Context) {
+	setUserStatus(c, model.UserStatusDisabled)
+}
+
+// 重新启用账号 邮箱未验证的账号恢复为待验证
+func EnableUser(c *gin.Context) {
+	setUserStatus(c, model.UserStatusActive)
+}
+
+func setUserStatus(c *gin.Context, status string) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	var value any = status
+	if status == model.UserStatusActive {
+		// 邮箱未验证的账号启用后仍为待验证 不能跳过邮箱验证
+		value = gorm.Expr("CASE WHEN email_verified_at IS NULL THEN ? ELSE ? END", model.UserStatusPending, model.UserStatusActive)
+	}
+	tx := config.DB.Model(&model.User{}).Where("id = ?", userId).Update("status", value)
+	if tx.Error != nil {
+		zap.S().Errorf("setUserStatus userId:%v status:%v err:%v", userId, status, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if tx.RowsAffected == 0 {
+		// 不存在 或状态本来就相同
+		var count int64
+		config.DB.Model(&model.User{}).Where("id = ?", userId).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+			return
+		}
+	}
+	// 删除缓存的用户信息
+	if err := cache.DeleteUserInfo(c.Request.Context(), strconv.FormatUint(userId, 10)); err != nil {
+		zap.S().Errorf("setUserStatus.DeleteUserInfo userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if status == model.UserStatusDisabled {
+		if err := cache.RevokeUserTokens(c.Request.Context(), uint(userId)); err != nil {
+			zap.S().Errorf("setUserStatus.RevokeUserTokens userId:%v err:%v", userId, err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 各缓存每一级的命中和未命中次数 进程启动后累计 多实例时只反映当前实例
+func CacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, pkg.SuccessWithData(cache.Stats()))
+}
@@ -0,0 +1,102 @@
+package logic_test
+
+import (
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+)
+
+// 管理后台的测试不要求两步验证
+func setupAdmin(t *testing.T) *testutil.Env {
+	t.Helper()
+	return testutil.Setup(t, func(c *config.ServerConfig) {
+		c.MFAConf.RequireForAdmin = false
+	})
+}
+
+func TestRequirePermission(t *testing.T) {
+	env := setupAdmin(t)
+	u := testutil.CreateUser(t, "quincy", password)
+	token := env.Login(t, "quincy", password).AccessToken
+	if r := env.JSON(t, http.MethodGet, "/admin/users", "", token); r.Code != pkg.UserPermissionErrCode {
+		t.Fatalf("没有角色时应拒绝访问 code:%v", r.Code)
+	}
+
+	// 只能查看用户的角色
+	var perm model.Permission
+	if err := config.DB.Where("name = ?", model.PermUsersRead).First(&perm).Error; err != nil {
+		t.Fatalf("查询权限失败 err:%v", err)
+	}
+	viewer := model.Role{Name: "viewer", Permissions: []model.Permission{perm}}
+	if err := config.DB.Create(&viewer).Error; err != nil {
+		t.Fatalf("创建角色失败 err:%v", err)
+	}
+	if err := config.DB.Model(&u).Association("Roles").Append(&viewer); err != nil {
+		t.Fatalf("分配角色失败 err:%v", err)
+	}
+	token = env.Login(t, "quincy", password).AccessToken
+	if r := env.JSON(t, http.MethodGet, "/admin/users", "", token); r.Code != pkg.SuccessCode {
+		t.Fatalf("拥有 users:read 时应可查看用户 code:%v", r.Code)
+	}
+	body := `{"roles":["admin"]}`
+	if r := env.JSON(t, http.MethodPut, fmt.Sprintf("/admin/users/%v/roles", u.ID), body, token); r.Code != pkg.UserPermissionErrCode {
+		t.Fatalf("缺少 roles:write 时应拒绝分配角色 code:%v", r.Code)
+	}
+}
+
+func TestSetUserRolesRevokesTokens(t *testing.T) {
+	env := setupAdmin(t)
+	grantAdmin(t, testutil.CreateUser(t, "root", password))
+	admin := env.Login(t, "root", password).AccessToken
+	u := testutil.CreateUser(t, "rita", password)
+	old := env.Login(t, "rita", password)
+
+	r := env.JSON(t, http.MethodPut, fmt.Sprintf("/admin/users/%v/roles", u.ID), `{"roles":["admin"]}`, admin)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("分配角色失败 code:%v", r.Code)
+	}
+	// 旧令牌中的权限已过时 全部失效
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", old.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("角色变更前的 access token 应失效")
+	}
+	if _, code := refresh(t, env, old.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("角色变更前的 refresh token 应失效 code:%v", code)
+	}
+	// 重新登录后获得新角色的权限
+	token := env.Login(t, "rita", password).AccessToken
+	if r := env.JSON(t, http.MethodGet, "/admin/users", "", token); r.Code != pkg.SuccessCode {
+		t.Fatalf("重新登录后应拥有新角色的权限 code:%v", r.Code)
+	}
+	// 操作者自己的令牌不受影响
+	if r := env.JSON(t, http.MethodGet, "/admin/users", "", admin); r.Code != pkg.SuccessCode {
+		t.Fatalf("操作者的令牌不应失效 code:%v", r.Code)
+	}
+}
+
+func TestEnableUserKeepsPending(t *testing.T) {
+	env := setupAdmin(t)
+	grantAdmin(t, testutil.CreateUser(t, "root", password))
+	admin := env.Login(t, "root", password).AccessToken
+	pending := createPendingUser(t, "sam")
+	active := testutil.CreateUser(t, "tina", password)
+
+	for _, u := range []model.User{pending, active} {
+		for _, action := range []string{"disable", "enable"} {
+			if r := env.JSON(t, http.MethodPost, fmt.Sprintf("/admin/users/%v/%v", u.ID, action), "", admin); r.Code != pkg.SuccessCode {
+				t.Fatalf("%v 失败 username:%v code:%v", action, u.Username, r.Code)
+			}
+		}
+	}
+	// 启用不能跳过邮箱验证
+	for u, want := range map[uint]string{pending.ID: model.UserStatusPending, active.ID: model.UserStatusActive} {
+		var got model.User
+		config.DB.First(&got, u)
+		if got.Status != want {
+			t.Fatalf("启用后的状态 username:%v got:%v want:%v", got.Username, got.Status, want)
+		}
+	}
+}
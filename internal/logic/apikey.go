@@ -0,0 +1,214 @@
+package logic
+
+import (
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 明文key的前缀 便于在日志和代码仓库中识别泄露的key
+const apiKeyPrefix = "gwp_"
+
+func toAPIKeyItem(k *model.APIKey) api.APIKeyItem {
+	return api.APIKeyItem{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.ScopeList(),
+		MFA:        k.MFA,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
+
+// 创建 API key scope不能超出当前用户的权限
+func CreateAPIKey(c *gin.Context) {
+	var r api.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	conf := config.Config.APIKeyConf
+	scopes := make([]string, 0, len(r.Scopes))
+	privileged := false
+	for _, scope := range r.Scopes {
+		if !model.ValidScope(scope) {
+			c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "未知的scope "+scope))
+			return
+		}
+		if scope != model.ScopeProfile {
+			if !slices.Contains(currentUser.Perms, scope) {
+				c.JSON(http.StatusOK, pkg.Fail(pkg.UserPermissionErrCode))
+				return
+			}
+			privileged = true
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	// 带管理权限的key可以访问管理后台 创建时要求两步验证登录
+	if privileged && config.Config.MFAConf.RequireForAdmin && !currentUser.MFA() {
+		c.JSON(http.StatusForbidden, pkg.Fail(pkg.UserMFARequiredErrCode))
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(conf.DefaultTTL)
+	if r.ExpiresAt != nil {
+		if !r.ExpiresAt.After(now) || r.ExpiresAt.After(now.Add(conf.MaxTTL)) {
+			c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "过期时间超出范围"))
+			return
+		}
+		expiresAt = *r.ExpiresAt
+	}
+	var count int64
+	tx := config.DB.Model(&model.APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", currentUser.UserID, now).
+		Count(&count)
+	if tx.Error != nil {
+		zap.S().Errorf("CreateAPIKey count userId:%v err:%v", currentUser.UserID, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if count >= conf.MaxPerUser {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserAPIKeyLimitErrCode))
+		return
+	}
+	secret, err := pkg.RandomToken(32)
+	if err != nil {
+		zap.S().Errorf("CreateAPIKey.RandomToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	key := apiKeyPrefix + secret
+	k := model.APIKey{
+		UserID:    currentUser.UserID,
+		Name:      r.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   pkg.HashToken(key),
+		Scopes:    strings.Join(scopes, ","),
+		MFA:       currentUser.MFA(),
+		ExpiresAt: expiresAt,
+	}
+	if err := config.DB.Create(&k).Error; err != nil {
+		zap.S().Errorf("CreateAPIKey create userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, currentUser.UserID, currentUser.Username, model.EventAPIKeyCreate, k.Prefix+" "+k.Scopes)
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.CreateAPIKeyResponse{
+		APIKeyItem: toAPIKeyItem(&k),
+		Key:        key,
+	}))
+}
+
+func listAPIKeys(c *gin.Context, userId uint) {
+	var keys []model.APIKey
+	if err := config.DB.Where("user_id = ?", userId).Order("id DESC").Find(&keys).Error; err != nil {
+		zap.S().Errorf("listAPIKeys userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	list := make([]api.APIKeyItem, 0, len(keys))
+	for i := range keys {
+		list = append(list, toAPIKeyItem(&keys[i]))
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(list))
+}
+
+// 吊销key 已吊销的key重复吊销直接返回成功
+// userId 为0时不限制所属用户 供管理员使用
+func revokeAPIKey(c *gin.Context, userId uint) {
+	keyId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	tx := config.DB.Where("id = ?", keyId)
+	if userId != 0 {
+		tx = tx.Where("user_id = ?", userId)
+	}
+	k := model.APIKey{}
+	err = tx.First(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("revokeAPIKey query keyId:%v err:%v", keyId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if k.RevokedAt == nil {
+		if err := config.DB.Model(&k).Update("revoked_at", time.Now()).Error; err != nil {
+			zap.S().Errorf("revokeAPIKey update keyId:%v err:%v", keyId, err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+		operator, _ := middleware.CurrentUser(c)
+		// 管理员吊销其他用户的key时 记录key所属用户的用户名
+		username := operator.Username
+		if k.UserID != operator.UserID {
+			owner := model.User{}
+			if err := config.DB.Select("username").First(&owner, k.UserID).Error; err != nil {
+				zap.S().Errorf("revokeAPIKey query owner userId:%v err:%v", k.UserID, err)
+			}
+			username = owner.Username
+		}
+		recordEvent(c, k.UserID, username, model.EventAPIKeyRevoke, k.Prefix+" by "+operator.Username)
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 当前用户的 API key 不返回明文
+func ListAPIKeys(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	listAPIKeys(c, currentUser.UserID)
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	revokeAPIKey(c, currentUser.UserID)
+}
+
+// 管理员查看指定用户的 API key
+func ListUserAPIKeys(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	listAPIKeys(c, uint(userId))
+}
+
+// 管理员吊销任意用户的 API key
+func AdminRevokeAPIKey(c *gin.Context) {
+	revokeAPIKey(c, 0)
+}
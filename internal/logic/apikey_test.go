@@ -0,0 +1,109 @@
+package logic_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 给用户分配管理员角色
+func grantAdmin(t *testing.T, u model.User) {
+	t.Helper()
+	admin := model.Role{}
+	if err := config.DB.Where("name = ?", model.RoleAdmin).First(&admin).Error; err != nil {
+		t.Fatalf("查询管理员角色失败 err:%v", err)
+	}
+	if err := config.DB.Model(&u).Association("Roles").Append(&admin); err != nil {
+		t.Fatalf("分配管理员角色失败 err:%v", err)
+	}
+}
+
+func createAPIKey(t *testing.T, env *testutil.Env, token string) api.CreateAPIKeyResponse {
+	t.Helper()
+	r := env.JSON(t, http.MethodPost, "/user/api-keys", `{"name":"ci","scopes":["users:read"]}`, token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("创建 API key 失败 code:%v", r.Code)
+	}
+	var key api.CreateAPIKeyResponse
+	r.Decode(t, &key)
+	return key
+}
+
+func adminWithKey(t *testing.T, env *testutil.Env, key string) testutil.Response {
+	t.Helper()
+	w := env.Do(http.MethodGet, "/admin/users", "", map[string]string{"X-API-Key": key})
+	var r testutil.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("响应不是json status:%v body:%s", w.Code, w.Body.String())
+	}
+	return r
+}
+
+func TestAPIKeyRequireMFA(t *testing.T) {
+	env := testutil.Setup(t)
+	u := testutil.CreateUser(t, "henry", password)
+	grantAdmin(t, u)
+
+	// 关闭两步验证要求期间 未经两步验证创建的key
+	config.Config.MFAConf.RequireForAdmin = false
+	plain := createAPIKey(t, env, env.Login(t, "henry", password).AccessToken)
+	config.Config.MFAConf.RequireForAdmin = true
+	if plain.MFA {
+		t.Fatalf("未经两步验证创建的key不应标记为 mfa")
+	}
+	if r := adminWithKey(t, env, plain.Key); r.Code != pkg.UserMFARequiredErrCode {
+		t.Fatalf("未经两步验证创建的key不能访问管理后台 code:%v", r.Code)
+	}
+
+	secret, _ := enableTOTP(t, env, env.Login(t, "henry", password).AccessToken)
+	code := totpCode(t, secret, time.Now().Unix()/pkg.TOTPPeriod)
+	pair, c := loginMFA(t, env, loginPending(t, env, "henry"), code)
+	if c != pkg.SuccessCode {
+		t.Fatalf("两步验证登录失败 code:%v", c)
+	}
+	key := createAPIKey(t, env, pair.AccessToken)
+	if !key.MFA {
+		t.Fatalf("两步验证登录后创建的key应标记为 mfa")
+	}
+	if r := adminWithKey(t, env, key.Key); r.Code != pkg.SuccessCode {
+		t.Fatalf("两步验证登录后创建的key应可访问管理后台 code:%v", r.Code)
+	}
+}
+
+func TestRevokeAPIKeyRecordsUsername(t *testing.T) {
+	env := testutil.Setup(t, func(c *config.ServerConfig) {
+		c.MFAConf.RequireForAdmin = false
+	})
+	grantAdmin(t, testutil.CreateUser(t, "root", password))
+	admin := env.Login(t, "root", password).AccessToken
+	// 创建的key带 users:read 需要创建者拥有该权限
+	grantAdmin(t, testutil.CreateUser(t, "iris", password))
+	token := env.Login(t, "iris", password).AccessToken
+
+	own := createAPIKey(t, env, token)
+	if r := env.JSON(t, http.MethodDelete, fmt.Sprintf("/user/api-keys/%v", own.ID), "", token); r.Code != pkg.SuccessCode {
+		t.Fatalf("吊销 API key 失败 code:%v", r.Code)
+	}
+	byAdmin := createAPIKey(t, env, token)
+	if r := env.JSON(t, http.MethodDelete, fmt.Sprintf("/admin/api-keys/%v", byAdmin.ID), "", admin); r.Code != pkg.SuccessCode {
+		t.Fatalf("管理员吊销 API key 失败 code:%v", r.Code)
+	}
+	// 两条记录都使用key所属用户的用户名
+	var events []model.SecurityEvent
+	config.DB.Where("type = ?", model.EventAPIKeyRevoke).Find(&events)
+	if len(events) != 2 {
+		t.Fatalf("吊销记录数量 got:%v", len(events))
+	}
+	for _, e := range events {
+		if e.Username != "iris" {
+			t.Fatalf("吊销记录的用户名 got:%q detail:%v", e.Username, e.Detail)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package logic
+
+import (
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 登录失败原因 写入 SecurityEvent.Detail
+const (
+	reasonUserNotFound = "user_not_found"
+	reasonBadPassword  = "bad_password"
+	reasonBadMFACode   = "bad_mfa_code"
+	reasonDisabled     = "disabled"
+	reasonNotVerified  = "not_verified"
+)
+
+// 按列宽截断 防止超长的请求头导致写入失败
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// 记录安全事件 写入失败只记录日志 不影响业务
+func recordEvent(c *gin.Context, userId uint, username, typ, detail string) {
+	e := model.SecurityEvent{
+		UserID:    userId,
+		Username:  truncate(username, 64),
+		Type:      typ,
+		IP:        c.ClientIP(),
+		UserAgent: truncate(c.Request.UserAgent(), 255),
+		Detail:    truncate(detail, 255),
+	}
+	if err := config.DB.Create(&e).Error; err != nil {
+		zap.S().Errorf("recordEvent userId:%v type:%v detail:%v err:%v", userId, typ, detail, err)
+	}
+}
+
+// 按条件分页查询安全事件 按id倒序
+func listSecurityEvents(c *gin.Context, tx *gorm.DB, r *api.SecurityEventsRequest) {
+	if r.Limit == 0 {
+		r.Limit = 20
+	}
+	if r.Type != "" {
+		tx = tx.Where("type = ?", r.Type)
+	}
+	if !r.From.IsZero() {
+		tx = tx.Where("created_at >= ?", r.From)
+	}
+	if !r.To.IsZero() {
+		tx = tx.Where("created_at < ?", r.To)
+	}
+	if r.Cursor != "" {
+		cur, err := decodeCursor(r.Cursor)
+		if err != nil {
+			c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, "cursor无效"))
+			return
+		}
+		tx = tx.Where("id < ?", cur.ID)
+	}
+	var events []model.SecurityEvent
+	// 多取一条判断是否还有下一页
+	if err := tx.Order("id DESC").Limit(r.Limit + 1).Find(&events).Error; err != nil {
+		zap.S().Errorf("listSecurityEvents err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	resp := api.SecurityEventListResponse{
+		List:   make([]api.SecurityEventItem, 0, len(events)),
+		Paging: api.Paging{Limit: r.Limit},
+	}
+	if len(events) > r.Limit {
+		events = events[:r.Limit]
+		resp.Paging.HasMore = true
+		resp.Paging.NextCursor = encodeCursor(userCursor{ID: events[len(events)-1].ID})
+	}
+	for _, e := range events {
+		resp.List = append(resp.List, api.SecurityEventItem{
+			ID:        e.ID,
+			UserID:    e.UserID,
+			Username:  e.Username,
+			Type:      e.Type,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+			Detail:    e.Detail,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(resp))
+}
+
+// 当前用户自己的登录和安全记录
+func ListMySecurityEvents(c *gin.Context) {
+	var r api.SecurityEventsRequest
+	if err := c.ShouldBindQuery(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	tx := config.DB.Model(&model.SecurityEvent{}).Where("user_id = ?", currentUser.UserID)
+	listSecurityEvents(c, tx, &r)
+}
+
+// 管理后台查询全部安全事件 可按用户、类型和时间过滤
+func ListSecurityEvents(c *gin.Context) {
+	var r api.AdminSecurityEventsRequest
+	if err := c.ShouldBindQuery(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	tx := config.DB.Model(&model.SecurityEvent{})
+	if r.UserID != 0 {
+		tx = tx.Where("user_id = ?", r.UserID)
+	}
+	if r.Username != "" {
+		tx = tx.Where("username = ?", r.Username)
+	}
+	listSecurityEvents(c, tx, &r.SecurityEventsRequest)
+}
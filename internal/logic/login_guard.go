@@ -0,0 +1,82 @@
+package logic
+
+import (
+	"errors"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 写入锁定响应 携带 Retry-After
+func abortLocked(c *gin.Context, remaining time.Duration) {
+	seconds := int(math.Ceil(remaining.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.UserLockedErrCode, strconv.Itoa(seconds)+"秒后重试"))
+}
+
+// 用户名或ip处于锁定中时直接返回 true 并写入响应
+func loginLocked(c *gin.Context, username string) bool {
+	remaining, err := cache.LoginLockRemaining(c.Request.Context(), username, c.ClientIP())
+	if err != nil {
+		zap.S().Errorf("loginLocked.LoginLockRemaining username:%v ip:%v err:%v", username, c.ClientIP(), err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return true
+	}
+	if remaining > 0 {
+		abortLocked(c, remaining)
+		return true
+	}
+	return false
+}
+
+// 记录登录失败并写入审计记录 触发锁定时记录安全日志
+// 用户不存在时 userId 为0
+func loginFailed(c *gin.Context, userId uint, username, reason string) {
+	recordEvent(c, userId, username, model.EventLoginFailure, reason)
+	fails, locked, err := cache.RecordLoginFailure(c.Request.Context(), username, c.ClientIP())
+	if err != nil {
+		zap.S().Errorf("loginFailed.RecordLoginFailure username:%v ip:%v err:%v", username, c.ClientIP(), err)
+		return
+	}
+	if fails >= config.Config.LoginGuardConf.MaxFailures || locked >= config.Config.LoginGuardConf.Lockout {
+		zap.S().Warnf("[LoginLockout] 登录失败次数过多 账号已锁定 username:%v ip:%v failures:%v lock:%v", username, c.ClientIP(), fails, locked)
+	}
+}
+
+// 管理员解除账号的登录锁定
+func UnlockUser(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	user := model.User{}
+	tx := config.DB.First(&user, userId)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if tx.Error != nil {
+		zap.S().Errorf("UnlockUser query user userId:%v err:%v", userId, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := cache.ResetLoginFailures(c.Request.Context(), user.Username); err != nil {
+		zap.S().Errorf("UnlockUser.ResetLoginFailures userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	operator, _ := middleware.CurrentUser(c)
+	zap.S().Infof("[LoginUnlock] 管理员解除锁定 username:%v operator:%v ip:%v", user.Username, operator.Username, c.ClientIP())
+	c.JSON(http.StatusOK, pkg.Success())
+}
@@ -0,0 +1,127 @@
+package logic_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 登录并返回统一响应和 Retry-After
+func tryLogin(t *testing.T, env *testutil.Env, username, pwd string) (pkg.Code, string) {
+	t.Helper()
+	w := env.Do(http.MethodPost, "/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, pwd), nil)
+	var r testutil.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("登录响应不是json status:%v body:%s", w.Code, w.Body.String())
+	}
+	return r.Code, w.Header().Get("Retry-After")
+}
+
+// 只按失败次数锁定 不触发退避
+func setupLoginGuard(t *testing.T, configure func(c *config.ServerConfig)) *testutil.Env {
+	t.Helper()
+	return testutil.Setup(t, func(c *config.ServerConfig) {
+		c.MFAConf.RequireForAdmin = false
+		c.LoginGuardConf.MaxFailures = 3
+		c.LoginGuardConf.IPMaxFailures = 100
+		c.LoginGuardConf.Lockout = 15 * time.Minute
+		c.LoginGuardConf.BackoffAfter = 100
+		if configure != nil {
+			configure(c)
+		}
+	})
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	env := setupLoginGuard(t, nil)
+	grantAdmin(t, testutil.CreateUser(t, "root", password))
+	admin := env.Login(t, "root", password).AccessToken
+	u := testutil.CreateUser(t, "uma", password)
+
+	for i := 0; i < 3; i++ {
+		if code, _ := tryLogin(t, env, "uma", "wrong"); code != pkg.UserPasswordErrCode {
+			t.Fatalf("第%v次密码错误 code:%v", i+1, code)
+		}
+	}
+	// 达到次数后即使密码正确也被锁定 换大小写同样锁定
+	for _, name := range []string{"uma", "UMA"} {
+		code, retry := tryLogin(t, env, name, password)
+		if code != pkg.UserLockedErrCode || retry != "900" {
+			t.Fatalf("锁定期间应拒绝登录 username:%v code:%v Retry-After:%v", name, code, retry)
+		}
+	}
+
+	if r := env.JSON(t, http.MethodPost, fmt.Sprintf("/admin/users/%v/unlock", u.ID), "", admin); r.Code != pkg.SuccessCode {
+		t.Fatalf("解除锁定失败 code:%v", r.Code)
+	}
+	if code, _ := tryLogin(t, env, "uma", password); code != pkg.SuccessCode {
+		t.Fatalf("解除锁定后应可登录 code:%v", code)
+	}
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	env := setupLoginGuard(t, nil)
+	testutil.CreateUser(t, "victor", password)
+
+	tryLogin(t, env, "victor", "wrong")
+	tryLogin(t, env, "victor", "wrong")
+	if code, _ := tryLogin(t, env, "victor", password); code != pkg.SuccessCode {
+		t.Fatalf("未达到次数时应可登录 code:%v", code)
+	}
+	// 成功登录后重新计数
+	tryLogin(t, env, "victor", "wrong")
+	tryLogin(t, env, "victor", "wrong")
+	if code, _ := tryLogin(t, env, "victor", password); code != pkg.SuccessCode {
+		t.Fatalf("登录成功后应清除失败次数 code:%v", code)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	env := setupLoginGuard(t, func(c *config.ServerConfig) {
+		c.LoginGuardConf.MaxFailures = 10
+		c.LoginGuardConf.BackoffAfter = 1
+		c.LoginGuardConf.BackoffBase = time.Second
+		c.LoginGuardConf.BackoffMax = time.Minute
+	})
+	testutil.CreateUser(t, "wendy", password)
+
+	if code, _ := tryLogin(t, env, "wendy", "wrong"); code != pkg.UserPasswordErrCode {
+		t.Fatalf("第1次密码错误 code:%v", code)
+	}
+	// 超过 backoff_after 后需要等待 base*2^(n-backoff_after-1)
+	tryLogin(t, env, "wendy", "wrong")
+	if code, retry := tryLogin(t, env, "wendy", password); code != pkg.UserLockedErrCode || retry != "1" {
+		t.Fatalf("退避期间应拒绝登录 code:%v Retry-After:%v", code, retry)
+	}
+	env.Redis.FastForward(time.Second)
+	tryLogin(t, env, "wendy", "wrong")
+	if code, retry := tryLogin(t, env, "wendy", password); code != pkg.UserLockedErrCode || retry != "2" {
+		t.Fatalf("退避时间应翻倍 code:%v Retry-After:%v", code, retry)
+	}
+	env.Redis.FastForward(2 * time.Second)
+	if code, _ := tryLogin(t, env, "wendy", password); code != pkg.SuccessCode {
+		t.Fatalf("退避结束后应可登录 code:%v", code)
+	}
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	env := setupLoginGuard(t, func(c *config.ServerConfig) {
+		c.LoginGuardConf.IPMaxFailures = 3
+	})
+	testutil.CreateUser(t, "xavier", password)
+
+	// 同一ip尝试不同的用户名 每个用户名都未达到次数
+	for _, name := range []string{"nobody1", "nobody2", "nobody3"} {
+		if code, _ := tryLogin(t, env, name, "wrong"); code != pkg.RecordNotFoundErrCode {
+			t.Fatalf("用户不存在 username:%v code:%v", name, code)
+		}
+	}
+	if code, _ := tryLogin(t, env, "xavier", password); code != pkg.UserLockedErrCode {
+		t.Fatalf("ip锁定后其他用户名同样无法登录 code:%v", code)
+	}
+}
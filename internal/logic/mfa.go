@@ -0,0 +1,466 @@
+package logic
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 用户的TOTP记录 未发起绑定时返回 gorm.ErrRecordNotFound
+func loadTOTP(userId uint) (*model.UserTOTP, error) {
+	totp := model.UserTOTP{}
+	tx := config.DB.Where("user_id = ?", userId).First(&totp)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &totp, nil
+}
+
+// 是否已确认开启两步验证
+func mfaEnabled(userId uint) (bool, error) {
+	var n int64
+	tx := config.DB.Model(&model.UserTOTP{}).Where("user_id = ? AND confirmed_at IS NOT NULL", userId).Count(&n)
+	return n > 0, tx.Error
+}
+
+// 恢复码忽略大小写、空格和分隔符
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != pkg.TOTPDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 校验TOTP验证码 成功后记录时间步 同一个验证码不能使用两次
+func useTOTPCode(totp *model.UserTOTP, code string) (bool, error) {
+	counter, ok := pkg.ValidateTOTP(totp.Secret, code, time.Now(), config.Config.MFAConf.Skew)
+	if !ok {
+		return false, nil
+	}
+	// 条件更新 并发或重放的请求更新不到记录
+	tx := config.DB.Model(&model.UserTOTP{}).Where("id = ? AND last_counter < ?", totp.ID, counter).Update("last_counter", counter)
+	return tx.RowsAffected == 1, tx.Error
+}
+
+// 校验验证码或恢复码 恢复码使用后立即作废
+func useMFACode(totp *model.UserTOTP, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if isTOTPCode(code) {
+		return useTOTPCode(totp, code)
+	}
+	now := time.Now()
+	tx := config.DB.Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", totp.UserID, pkg.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", &now)
+	if tx.RowsAffected == 1 {
+		zap.S().Infof("[MFARecovery] 使用恢复码 userId:%v", totp.UserID)
+	}
+	return tx.RowsAffected == 1, tx.Error
+}
+
+// 生成新的恢复码 旧的恢复码全部作废 明文只返回这一次
+// 需要在事务中调用 与调用方的其他修改一起提交
+func replaceRecoveryCodes(tx *gorm.DB, userId uint) ([]string, error) {
+	n := config.Config.MFAConf.RecoveryCodes
+	codes := make([]string, 0, n)
+	rows := make([]model.RecoveryCode, 0, n)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))[:10]
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		rows = append(rows, model.RecoveryCode{UserID: userId, CodeHash: pkg.HashToken(normalizeRecoveryCode(code))})
+	}
+	if err := tx.Unscoped().Where("user_id = ?", userId).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		if err := tx.Create(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// 密码校验通过 返回待验证token 由 LoginMFA 完成登录
+func startMFALogin(c *gin.Context, user *model.User) {
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		zap.S().Errorf("startMFALogin.RandomToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	expire := config.Config.MFAConf.PendingExpire
+	if err := cache.SaveMFAPending(c.Request.Context(), token, user.ID, expire); err != nil {
+		zap.S().Errorf("startMFALogin.SaveMFAPending userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.MFAPendingResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(expire.Seconds()),
+	}))
+}
+
+// 登录第二步 使用待验证token和验证码换取令牌对
+func LoginMFA(c *gin.Context) {
+	var r api.LoginMFARequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	ctx := c.Request.Context()
+	userId, err := cache.GetMFAPending(ctx, r.MFAToken)
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFATokenErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("LoginMFA.GetMFAPending err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	user, err := loadUserWithRoles(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFATokenErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("LoginMFA.loadUserWithRoles userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 验证码错误同样计入登录失败 共用锁定策略
+	if loginLocked(c, user.Username) {
+		return
+	}
+	if user.Status == model.UserStatusDisabled {
+		recordEvent(c, user.ID, user.Username, model.EventLoginFailure, reasonDisabled)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserDisabledErrCode))
+		return
+	}
+	totp, err := loadTOTP(user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && totp.ConfirmedAt == nil) {
+		// 两步验证已在第一步之后被关闭 需要重新登录
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFATokenErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("LoginMFA.loadTOTP userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	ok, err := useMFACode(totp, r.Code)
+	if err != nil {
+		zap.S().Errorf("LoginMFA.useMFACode userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if !ok {
+		loginFailed(c, user.ID, user.Username, reasonBadMFACode)
+		attempts, err := cache.RecordMFAFailure(ctx, r.MFAToken)
+		if err != nil {
+			zap.S().Errorf("LoginMFA.RecordMFAFailure userId:%v err:%v", user.ID, err)
+		}
+		// 错误次数过多 作废待验证token 需要重新输入密码
+		if attempts >= config.Config.MFAConf.MaxAttempts {
+			if _, err := cache.DeleteMFAPending(ctx, r.MFAToken); err != nil {
+				zap.S().Errorf("LoginMFA.DeleteMFAPending userId:%v err:%v", user.ID, err)
+			}
+		}
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFACodeErrCode))
+		return
+	}
+	// 待验证token只能换取一次令牌
+	deleted, err := cache.DeleteMFAPending(ctx, r.MFAToken)
+	if err != nil {
+		zap.S().Errorf("LoginMFA.DeleteMFAPending userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFATokenErrCode))
+		return
+	}
+	if err := cache.ResetLoginFailures(ctx, user.Username); err != nil {
+		zap.S().Errorf("LoginMFA.ResetLoginFailures username:%v err:%v", user.Username, err)
+	}
+	pair, err := issueTokenPair(c, user, "", true)
+	if err != nil {
+		zap.S().Errorf("LoginMFA.issueTokenPair userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := middleware.SetAuthCookies(c, pair.AccessToken, pair.RefreshToken); err != nil {
+		zap.S().Errorf("LoginMFA.SetAuthCookies userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventLoginSuccess, "mfa")
+	c.JSON(http.StatusOK, pkg.SuccessWithData(pair))
+}
+
+// 两步验证状态
+func MFAStatus(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	enabled, err := mfaEnabled(currentUser.UserID)
+	if err != nil {
+		zap.S().Errorf("MFAStatus.mfaEnabled userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	resp := api.MFAStatusResponse{Enabled: enabled}
+	if enabled {
+		tx := config.DB.Model(&model.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", currentUser.UserID).Count(&resp.RecoveryCodesLeft)
+		if tx.Error != nil {
+			zap.S().Errorf("MFAStatus count recovery codes userId:%v err:%v", currentUser.UserID, tx.Error)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(resp))
+}
+
+// 发起绑定 生成新密钥 确认前可以重复调用 每次都会替换密钥
+func SetupTOTP(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	totp, err := loadTOTP(currentUser.UserID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		zap.S().Errorf("SetupTOTP.loadTOTP userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if totp != nil && totp.ConfirmedAt != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFAEnabledErrCode))
+		return
+	}
+	secret, err := pkg.NewTOTPSecret()
+	if err != nil {
+		zap.S().Errorf("SetupTOTP.NewTOTPSecret err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	var tx *gorm.DB
+	if totp == nil {
+		tx = config.DB.Create(&model.UserTOTP{UserID: currentUser.UserID, Secret: secret})
+	} else {
+		tx = config.DB.Model(totp).Updates(map[string]any{"secret": secret, "last_counter": 0})
+	}
+	if tx.Error != nil {
+		zap.S().Errorf("SetupTOTP save userId:%v err:%v", currentUser.UserID, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.TOTPSetupResponse{
+		Secret: secret,
+		URI:    pkg.TOTPURI(config.Config.MFAConf.Issuer, currentUser.Username, secret),
+	}))
+}
+
+// 使用验证器中的第一个验证码确认绑定 成功后返回恢复码
+func ConfirmTOTP(c *gin.Context) {
+	var r api.MFACodeRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	totp, err := loadTOTP(currentUser.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFASetupErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ConfirmTOTP.loadTOTP userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if totp.ConfirmedAt != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFAEnabledErrCode))
+		return
+	}
+	ok, err = useTOTPCode(totp, strings.TrimSpace(r.Code))
+	if err != nil {
+		zap.S().Errorf("ConfirmTOTP.useTOTPCode userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFACodeErrCode))
+		return
+	}
+	// 恢复码和开启状态一起提交 不会出现已开启但没有恢复码的情况
+	var codes []string
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if codes, err = replaceRecoveryCodes(tx, currentUser.UserID); err != nil {
+			return err
+		}
+		return tx.Model(totp).Update("confirmed_at", time.Now()).Error
+	})
+	if err != nil {
+		zap.S().Errorf("ConfirmTOTP save userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	zap.S().Infof("[MFAEnabled] 开启两步验证 userId:%v ip:%v", currentUser.UserID, c.ClientIP())
+	recordEvent(c, currentUser.UserID, currentUser.Username, model.EventMFAEnable, "")
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.RecoveryCodesResponse{RecoveryCodes: codes}))
+}
+
+// 关闭两步验证 需要同时提供密码和验证码(或恢复码)
+func DisableTOTP(c *gin.Context) {
+	var r api.DisableMFARequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	user := model.User{}
+	tx := config.DB.First(&user, currentUser.UserID)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if tx.Error != nil {
+		zap.S().Errorf("DisableTOTP query user userId:%v err:%v", currentUser.UserID, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	err := pkg.CheckPassWord(user.Password, r.Password)
+	if errors.Is(err, pkg.ErrPasswordMismatch) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserPasswordErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("DisableTOTP.CheckPassWord userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	totp, err := loadTOTP(user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && totp.ConfirmedAt == nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFASetupErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("DisableTOTP.loadTOTP userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	ok, err = useMFACode(totp, r.Code)
+	if err != nil {
+		zap.S().Errorf("DisableTOTP.useMFACode userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFACodeErrCode))
+		return
+	}
+	// 物理删除 之后可以重新绑定
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(totp).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error
+	})
+	if err != nil {
+		zap.S().Errorf("DisableTOTP delete userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	zap.S().Infof("[MFADisabled] 关闭两步验证 userId:%v ip:%v", user.ID, c.ClientIP())
+	recordEvent(c, user.ID, user.Username, model.EventMFADisable, "")
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 重新生成恢复码 需要验证码 旧恢复码全部作废
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var r api.MFACodeRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	totp, err := loadTOTP(currentUser.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && totp.ConfirmedAt == nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFASetupErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("RegenerateRecoveryCodes.loadTOTP userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	ok, err = useTOTPCode(totp, strings.TrimSpace(r.Code))
+	if err != nil {
+		zap.S().Errorf("RegenerateRecoveryCodes.useTOTPCode userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserMFACodeErrCode))
+		return
+	}
+	var codes []string
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, currentUser.UserID)
+		return err
+	})
+	if err != nil {
+		zap.S().Errorf("RegenerateRecoveryCodes.replaceRecoveryCodes userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.RecoveryCodesResponse{RecoveryCodes: codes}))
+}
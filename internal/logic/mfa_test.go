@@ -0,0 +1,149 @@
+package logic_test
+
+import (
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func totpCode(t *testing.T, secret string, counter int64) string {
+	t.Helper()
+	code, err := pkg.TOTPCode(secret, counter)
+	if err != nil {
+		t.Fatalf("TOTPCode err:%v", err)
+	}
+	return code
+}
+
+// 发起绑定并用上一个时间步的验证码确认 返回密钥和恢复码
+func enableTOTP(t *testing.T, env *testutil.Env, token string) (string, []string) {
+	t.Helper()
+	r := env.JSON(t, http.MethodPost, "/user/mfa/totp/setup", "", token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("发起绑定失败 code:%v", r.Code)
+	}
+	var setup api.TOTPSetupResponse
+	r.Decode(t, &setup)
+	// 留出当前时间步给之后的登录使用
+	code := totpCode(t, setup.Secret, time.Now().Unix()/pkg.TOTPPeriod-1)
+	r = env.JSON(t, http.MethodPost, "/user/mfa/totp/confirm", fmt.Sprintf(`{"code":%q}`, code), token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("确认绑定失败 code:%v", r.Code)
+	}
+	var codes api.RecoveryCodesResponse
+	r.Decode(t, &codes)
+	return setup.Secret, codes.RecoveryCodes
+}
+
+// 输入密码 返回待验证token
+func loginPending(t *testing.T, env *testutil.Env, username string) string {
+	t.Helper()
+	r := env.JSON(t, http.MethodPost, "/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, password), "")
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("登录失败 code:%v", r.Code)
+	}
+	var pending api.MFAPendingResponse
+	r.Decode(t, &pending)
+	if !pending.MFARequired || pending.MFAToken == "" {
+		t.Fatalf("开启两步验证后登录应返回 mfa_token")
+	}
+	return pending.MFAToken
+}
+
+func loginMFA(t *testing.T, env *testutil.Env, mfaToken, code string) (api.TokenResponse, pkg.Code) {
+	t.Helper()
+	r := env.JSON(t, http.MethodPost, "/login/mfa", fmt.Sprintf(`{"mfa_token":%q,"code":%q}`, mfaToken, code), "")
+	var pair api.TokenResponse
+	if r.Code == pkg.SuccessCode {
+		r.Decode(t, &pair)
+	}
+	return pair, r.Code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "erin", password)
+	pair := env.Login(t, "erin", password)
+	secret, recovery := enableTOTP(t, env, pair.AccessToken)
+	if len(recovery) != config.Config.MFAConf.RecoveryCodes {
+		t.Fatalf("恢复码数量 got:%v", len(recovery))
+	}
+
+	mfaToken := loginPending(t, env, "erin")
+	if _, code := loginMFA(t, env, mfaToken, "000000"); code != pkg.UserMFACodeErrCode {
+		t.Fatalf("错误的验证码应失败 code:%v", code)
+	}
+	code := totpCode(t, secret, time.Now().Unix()/pkg.TOTPPeriod)
+	pair, c := loginMFA(t, env, mfaToken, code)
+	if c != pkg.SuccessCode {
+		t.Fatalf("两步验证登录失败 code:%v", c)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", pair.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("两步验证登录后 access token 不可用 code:%v", r.Code)
+	}
+	// 待验证token只能使用一次
+	if _, c := loginMFA(t, env, mfaToken, code); c != pkg.UserMFATokenErrCode {
+		t.Fatalf("重复使用 mfa_token 应失败 code:%v", c)
+	}
+	// 同一个验证码不能再次使用
+	if _, c := loginMFA(t, env, loginPending(t, env, "erin"), code); c != pkg.UserMFACodeErrCode {
+		t.Fatalf("重放验证码应失败 code:%v", c)
+	}
+}
+
+func TestTOTPRecoveryCode(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "frank", password)
+	pair := env.Login(t, "frank", password)
+	_, recovery := enableTOTP(t, env, pair.AccessToken)
+
+	if _, c := loginMFA(t, env, loginPending(t, env, "frank"), recovery[0]); c != pkg.SuccessCode {
+		t.Fatalf("使用恢复码登录失败 code:%v", c)
+	}
+	if _, c := loginMFA(t, env, loginPending(t, env, "frank"), recovery[0]); c != pkg.UserMFACodeErrCode {
+		t.Fatalf("恢复码只能使用一次 code:%v", c)
+	}
+	r := env.JSON(t, http.MethodGet, "/user/mfa", "", pair.AccessToken)
+	var status api.MFAStatusResponse
+	r.Decode(t, &status)
+	if !status.Enabled || status.RecoveryCodesLeft != int64(len(recovery)-1) {
+		t.Fatalf("两步验证状态 got:%+v", status)
+	}
+}
+
+func TestConfirmTOTPRollback(t *testing.T) {
+	env := testutil.Setup(t)
+	u := testutil.CreateUser(t, "grace", password)
+	pair := env.Login(t, "grace", password)
+	r := env.JSON(t, http.MethodPost, "/user/mfa/totp/setup", "", pair.AccessToken)
+	var setup api.TOTPSetupResponse
+	r.Decode(t, &setup)
+
+	// 写入开启状态失败时 恢复码也不能留下
+	err := config.DB.Callback().Update().Before("gorm:update").Register("test:fail_confirm", func(db *gorm.DB) {
+		if dest, ok := db.Statement.Dest.(map[string]any); ok && dest["confirmed_at"] != nil {
+			db.AddError(errors.New("update failed"))
+		}
+	})
+	if err != nil {
+		t.Fatalf("注册回调失败 err:%v", err)
+	}
+	code := totpCode(t, setup.Secret, time.Now().Unix()/pkg.TOTPPeriod)
+	if r := env.JSON(t, http.MethodPost, "/user/mfa/totp/confirm", fmt.Sprintf(`{"code":%q}`, code), pair.AccessToken); r.Code != pkg.InternalErrCode {
+		t.Fatalf("写入失败时应返回错误 code:%v", r.Code)
+	}
+	var n int64
+	config.DB.Model(&model.RecoveryCode{}).Where("user_id = ?", u.ID).Count(&n)
+	if n != 0 {
+		t.Fatalf("开启失败后残留了 %v 个恢复码", n)
+	}
+}
@@ -0,0 +1,633 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 协议端点按 RFC 6749 返回错误 接入应用使用标准的OAuth库解析
+func oauthError(c *gin.Context, status int, code, desc string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code, "error_description": desc})
+}
+
+// 在地址上追加query参数 保留原有参数
+func appendQuery(u string, v url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + v.Encode()
+	}
+	return u + "?" + v.Encode()
+}
+
+// 回调地址已校验通过后 错误通过重定向交给应用
+func redirectError(c *gin.Context, redirectURI, state, code, desc string) {
+	v := url.Values{"error": {code}, "error_description": {desc}}
+	if state != "" {
+		v.Set("state", state)
+	}
+	c.Redirect(http.StatusFound, appendQuery(redirectURI, v))
+}
+
+func findOAuthClient(clientId string) (*model.OAuthClient, error) {
+	client := model.OAuthClient{}
+	if err := config.DB.Where("client_id = ?", clientId).First(&client).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// 解析申请的scope 必须都在应用允许的范围内 未指定时使用应用允许的全部scope
+func requestedScopes(client *model.OAuthClient, scope string) ([]string, bool) {
+	allowed := client.ScopeList()
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return allowed, true
+	}
+	scopes := make([]string, 0, len(requested))
+	for _, s := range requested {
+		if !slices.Contains(allowed, s) {
+			return nil, false
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, true
+}
+
+// 授权端点 校验请求后保存 跳转到前端的授权确认页
+func Authorize(c *gin.Context) {
+	q := c.Request.URL.Query()
+	client, err := findOAuthClient(q.Get("client_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// 应用或回调地址错误时不能重定向 防止开放重定向
+		oauthError(c, http.StatusBadRequest, "invalid_request", "unknown client_id")
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("Authorize.findOAuthClient clientId:%v err:%v", q.Get("client_id"), err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	uris := client.RedirectURIList()
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(uris) == 1 {
+		redirectURI = uris[0]
+	}
+	if !slices.Contains(uris, redirectURI) {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "redirect_uri mismatch")
+		return
+	}
+	state := q.Get("state")
+	if q.Get("response_type") != "code" {
+		redirectError(c, redirectURI, state, "unsupported_response_type", "only code is supported")
+		return
+	}
+	if !client.AllowGrant(model.GrantAuthorizationCode) {
+		redirectError(c, redirectURI, state, "unauthorized_client", "authorization_code grant not allowed")
+		return
+	}
+	// 所有应用都必须使用 PKCE S256 的 challenge 为43位
+	challenge := q.Get("code_challenge")
+	if q.Get("code_challenge_method") != "S256" || len(challenge) != 43 {
+		redirectError(c, redirectURI, state, "invalid_request", "PKCE with S256 is required")
+		return
+	}
+	scopes, ok := requestedScopes(client, q.Get("scope"))
+	if !ok {
+		redirectError(c, redirectURI, state, "invalid_scope", "scope not allowed for this client")
+		return
+	}
+	requestId, err := pkg.RandomToken(32)
+	if err != nil {
+		zap.S().Errorf("Authorize.RandomToken err:%v", err)
+		redirectError(c, redirectURI, state, "server_error", "")
+		return
+	}
+	err = cache.SaveOAuthRequest(c.Request.Context(), requestId, &cache.OAuthRequest{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         state,
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: challenge,
+	}, config.Config.OAuthConf.RequestExpire)
+	if err != nil {
+		zap.S().Errorf("Authorize.SaveOAuthRequest clientId:%v err:%v", client.ClientID, err)
+		redirectError(c, redirectURI, state, "server_error", "")
+		return
+	}
+	c.Redirect(http.StatusFound, appendQuery(config.Config.OAuthConf.ConsentURL, url.Values{"request": {requestId}}))
+}
+
+// 授权确认页 展示申请授权的应用和scope
+func GetOAuthConsent(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	r, err := cache.GetOAuthRequest(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.OAuthRequestErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("GetOAuthConsent.GetOAuthRequest err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	client, err := findOAuthClient(r.ClientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.OAuthRequestErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("GetOAuthConsent.findOAuthClient clientId:%v err:%v", r.ClientID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	consent := model.OAuthConsent{}
+	err = config.DB.Where("user_id = ? AND client_id = ?", currentUser.UserID, client.ClientID).First(&consent).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		zap.S().Errorf("GetOAuthConsent query consent userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.OAuthConsentInfo{
+		ClientID:   client.ClientID,
+		ClientName: client.Name,
+		Scopes:     r.Scopes,
+		Granted:    consent.ID != 0 && consent.Covers(r.Scopes),
+	}))
+}
+
+// 用户同意或拒绝授权 返回前端需要跳转的应用回调地址
+func SubmitOAuthConsent(c *gin.Context) {
+	var req api.OAuthConsentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	ctx := c.Request.Context()
+	r, err := cache.TakeOAuthRequest(ctx, c.Param("id"))
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.OAuthRequestErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("SubmitOAuthConsent.TakeOAuthRequest err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	v := url.Values{}
+	if r.State != "" {
+		v.Set("state", r.State)
+	}
+	if !req.Approve {
+		v.Set("error", "access_denied")
+		c.JSON(http.StatusOK, pkg.SuccessWithData(api.OAuthConsentResponse{RedirectTo: appendQuery(r.RedirectURI, v)}))
+		return
+	}
+	// 确认期间应用可能已被删除
+	if _, err := findOAuthClient(r.ClientID); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			zap.S().Errorf("SubmitOAuthConsent.findOAuthClient clientId:%v err:%v", r.ClientID, err)
+		}
+		c.JSON(http.StatusOK, pkg.Fail(pkg.OAuthRequestErrCode))
+		return
+	}
+	if err := saveOAuthConsent(c, currentUser, r); err != nil {
+		zap.S().Errorf("SubmitOAuthConsent.saveOAuthConsent userId:%v clientId:%v err:%v", currentUser.UserID, r.ClientID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 登录时间取会话创建的时间 刷新令牌不会改变
+	authTime := currentUser.IssuedAt
+	if currentUser.SessionID != "" {
+		t, err := cache.SessionCreatedAt(ctx, currentUser.SessionID)
+		if err == nil {
+			authTime = t.Unix()
+		} else if !errors.Is(err, redis.Nil) {
+			zap.S().Errorf("SubmitOAuthConsent.SessionCreatedAt sid:%v err:%v", currentUser.SessionID, err)
+		}
+	}
+	code, err := pkg.RandomToken(32)
+	if err != nil {
+		zap.S().Errorf("SubmitOAuthConsent.RandomToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	err = cache.SaveOAuthCode(ctx, code, &cache.OAuthCode{
+		OAuthRequest: *r,
+		UserID:       currentUser.UserID,
+		Username:     currentUser.Username,
+		AMR:          currentUser.AMR,
+		AuthTime:     authTime,
+	}, config.Config.OAuthConf.CodeExpire)
+	if err != nil {
+		zap.S().Errorf("SubmitOAuthConsent.SaveOAuthCode userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	v.Set("code", code)
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.OAuthConsentResponse{RedirectTo: appendQuery(r.RedirectURI, v)}))
+}
+
+// 记录用户同意的scope 与之前同意过的合并 有新增时写入审计记录
+func saveOAuthConsent(c *gin.Context, currentUser *middleware.Claims, r *cache.OAuthRequest) error {
+	consent := model.OAuthConsent{}
+	err := config.DB.Where("user_id = ? AND client_id = ?", currentUser.UserID, r.ClientID).First(&consent).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if consent.ID != 0 && consent.Covers(r.Scopes) {
+		return nil
+	}
+	scopes := strings.Fields(consent.Scopes)
+	for _, s := range r.Scopes {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if consent.ID == 0 {
+		consent = model.OAuthConsent{UserID: currentUser.UserID, ClientID: r.ClientID, Scopes: strings.Join(scopes, " ")}
+		err = config.DB.Create(&consent).Error
+	} else {
+		err = config.DB.Model(&consent).Update("scopes", strings.Join(scopes, " ")).Error
+	}
+	if err != nil {
+		return err
+	}
+	recordEvent(c, currentUser.UserID, currentUser.Username, model.EventOAuthConsent, r.ClientID+" "+strings.Join(r.Scopes, " "))
+	return nil
+}
+
+// 校验应用身份 支持 client_secret_basic、client_secret_post
+// allowPublic 为 true 时公开客户端只需提供 client_id
+func authenticateClient(c *gin.Context, allowPublic bool) (*model.OAuthClient, bool) {
+	clientId, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 2.3.1 先做 form 编码再放入 Basic 认证
+		clientId, _ = url.QueryUnescape(clientId)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientId, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	invalid := func() (*model.OAuthClient, bool) {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	if clientId == "" {
+		return invalid()
+	}
+	client, err := findOAuthClient(clientId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return invalid()
+	}
+	if err != nil {
+		zap.S().Errorf("authenticateClient.findOAuthClient clientId:%v err:%v", clientId, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+	if client.Public() {
+		if !allowPublic || secret != "" {
+			return invalid()
+		}
+		return client, true
+	}
+	if subtle.ConstantTimeCompare([]byte(pkg.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return invalid()
+	}
+	return client, true
+}
+
+// 令牌端点
+func OAuthToken(c *gin.Context) {
+	client, ok := authenticateClient(c, true)
+	if !ok {
+		return
+	}
+	switch c.PostForm("grant_type") {
+	case model.GrantAuthorizationCode:
+		tokenByCode(c, client)
+	case model.GrantClientCredentials:
+		tokenByClientCredentials(c, client)
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// 用授权码换取令牌 校验回调地址和 PKCE
+func tokenByCode(c *gin.Context, client *model.OAuthClient) {
+	if !client.AllowGrant(model.GrantAuthorizationCode) {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "")
+		return
+	}
+	oc, err := cache.TakeOAuthCode(c.Request.Context(), c.PostForm("code"))
+	if errors.Is(err, redis.Nil) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("tokenByCode.TakeOAuthCode err:%v", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if oc.ClientID != client.ClientID || oc.RedirectURI != c.PostForm("redirect_uri") {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "client_id or redirect_uri mismatch")
+		return
+	}
+	// RFC 7636 code_verifier 长度为 43-128
+	verifier := c.PostForm("code_verifier")
+	if len(verifier) < 43 || len(verifier) > 128 ||
+		subtle.ConstantTimeCompare([]byte(oidc.CodeChallenge(verifier)), []byte(oc.CodeChallenge)) != 1 {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+		return
+	}
+	// 授权后账号可能已被删除或禁用
+	user := model.User{}
+	err = config.DB.First(&user, oc.UserID).Error
+	if err != nil || user.Status == model.UserStatusDisabled {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			zap.S().Errorf("tokenByCode query user userId:%v err:%v", oc.UserID, err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "user unavailable")
+		return
+	}
+	// 授权码签发后用户可能已撤销授权
+	var n int64
+	err = config.DB.Model(&model.OAuthConsent{}).Where("user_id = ? AND client_id = ?", user.ID, client.ClientID).Count(&n).Error
+	if err != nil {
+		zap.S().Errorf("tokenByCode query consent userId:%v err:%v", user.ID, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if n == 0 {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "consent revoked")
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(config.Config.OAuthConf.AccessExpire).Unix()
+	sub := strconv.FormatUint(uint64(user.ID), 10)
+	resp, ok := issueOAuthToken(c, &middleware.OAuthClaims{
+		ClientID:       client.ClientID,
+		Scope:          strings.Join(oc.Scopes, " "),
+		UserID:         user.ID,
+		Username:       user.Username,
+		StandardClaims: jwt.StandardClaims{Subject: sub, ExpiresAt: expiresAt},
+	})
+	if !ok {
+		return
+	}
+	if slices.Contains(oc.Scopes, model.ScopeOpenID) {
+		claims := &middleware.IDTokenClaims{
+			Nonce:    oc.Nonce,
+			AuthTime: oc.AuthTime,
+			AMR:      oc.AMR,
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    config.Config.OAuthConf.Issuer,
+				Audience:  client.ClientID,
+				Subject:   sub,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: expiresAt,
+			},
+		}
+		if slices.Contains(oc.Scopes, model.ScopeProfile) {
+			claims.PreferredUsername = user.Username
+		}
+		if slices.Contains(oc.Scopes, model.ScopeEmail) {
+			verified := user.EmailVerifiedAt != nil
+			claims.Email, claims.EmailVerified = user.Email, &verified
+		}
+		resp.IDToken, err = middleware.GetJWT().Sign(claims, "")
+		if err != nil {
+			zap.S().Errorf("tokenByCode sign id_token userId:%v err:%v", user.ID, err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// 应用以自身身份访问其他服务 不涉及用户 只允许有密钥的应用使用
+func tokenByClientCredentials(c *gin.Context, client *model.OAuthClient) {
+	if client.Public() || !client.AllowGrant(model.GrantClientCredentials) {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "")
+		return
+	}
+	scopes, ok := requestedScopes(client, c.PostForm("scope"))
+	if !ok {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", "scope not allowed for this client")
+		return
+	}
+	// 没有用户 不签发 id_token
+	scopes = slices.DeleteFunc(scopes, func(s string) bool { return s == model.ScopeOpenID })
+	expiresAt := time.Now().Add(config.Config.OAuthConf.AccessExpire).Unix()
+	resp, ok := issueOAuthToken(c, &middleware.OAuthClaims{
+		ClientID:       client.ClientID,
+		Scope:          strings.Join(scopes, " "),
+		StandardClaims: jwt.StandardClaims{Subject: client.ClientID, ExpiresAt: expiresAt},
+	})
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// 签发访问令牌 失败时写入错误响应
+func issueOAuthToken(c *gin.Context, claims *middleware.OAuthClaims) (*api.OAuthTokenResponse, bool) {
+	token, err := middleware.GetJWT().GenerateOAuthToken(claims)
+	if err != nil {
+		zap.S().Errorf("issueOAuthToken clientId:%v err:%v", claims.ClientID, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	return &api.OAuthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(config.Config.OAuthConf.AccessExpire / time.Second),
+		Scope:       claims.Scope,
+	}, true
+}
+
+// 访问令牌是否仍然有效 已吊销、用户令牌已全部吊销、用户已撤销授权或应用已删除时失效
+func oauthTokenActive(c *gin.Context, claims *middleware.OAuthClaims) (bool, error) {
+	revoked, err := cache.IsAccessTokenRevoked(c.Request.Context(), claims.Id, claims.UserID, claims.IssuedAtMillis(), "")
+	if err != nil || revoked {
+		return false, err
+	}
+	// client_credentials 签发的令牌没有用户
+	if claims.UserID != 0 {
+		revoked, err = cache.IsOAuthClientTokenRevoked(c.Request.Context(), claims.UserID, claims.ClientID, claims.IssuedAtMillis())
+		if err != nil || revoked {
+			return false, err
+		}
+	}
+	_, err = findOAuthClient(claims.ClientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 令牌自省 RFC 7662 供资源服务校验令牌 只允许有密钥的应用调用
+func IntrospectOAuthToken(c *gin.Context) {
+	if _, ok := authenticateClient(c, false); !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	claims, err := middleware.GetJWT().ParseOAuthToken(c.PostForm("token"))
+	if err != nil {
+		c.JSON(http.StatusOK, api.OAuthIntrospection{})
+		return
+	}
+	active, err := oauthTokenActive(c, claims)
+	if err != nil {
+		zap.S().Errorf("IntrospectOAuthToken.oauthTokenActive jti:%v err:%v", claims.Id, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if !active {
+		c.JSON(http.StatusOK, api.OAuthIntrospection{})
+		return
+	}
+	c.JSON(http.StatusOK, api.OAuthIntrospection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Username:  claims.Username,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.Id,
+	})
+}
+
+// 吊销令牌 RFC 7009 应用只能吊销签发给自己的令牌 无效的令牌同样返回成功
+func RevokeOAuthToken(c *gin.Context) {
+	client, ok := authenticateClient(c, true)
+	if !ok {
+		return
+	}
+	claims, err := middleware.GetJWT().ParseOAuthToken(c.PostForm("token"))
+	if err == nil && claims.ClientID == client.ClientID {
+		ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+		if err := cache.DenyAccessToken(c.Request.Context(), claims.Id, ttl); err != nil {
+			zap.S().Errorf("RevokeOAuthToken.DenyAccessToken jti:%v err:%v", claims.Id, err)
+			oauthError(c, http.StatusServiceUnavailable, "server_error", "")
+			return
+		}
+	}
+	c.Status(http.StatusOK)
+}
+
+// OIDC userinfo 需要带 openid scope 的用户访问令牌
+func OAuthUserInfo(c *gin.Context) {
+	bearerError := func(status int, code string) {
+		c.Header("WWW-Authenticate", `Bearer error="`+code+`"`)
+		oauthError(c, status, code, "")
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	claims, err := middleware.GetJWT().ParseOAuthToken(token)
+	if err != nil {
+		bearerError(http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	active, err := oauthTokenActive(c, claims)
+	if err != nil {
+		zap.S().Errorf("OAuthUserInfo.oauthTokenActive jti:%v err:%v", claims.Id, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if !active {
+		bearerError(http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	if claims.UserID == 0 || !claims.HasScope(model.ScopeOpenID) {
+		bearerError(http.StatusForbidden, "insufficient_scope")
+		return
+	}
+	user := model.User{}
+	err = config.DB.First(&user, claims.UserID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bearerError(http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("OAuthUserInfo query user userId:%v err:%v", claims.UserID, err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	info := gin.H{"sub": claims.Subject}
+	if claims.HasScope(model.ScopeProfile) {
+		info["preferred_username"] = user.Username
+	}
+	if claims.HasScope(model.ScopeEmail) {
+		info["email"] = user.Email
+		info["email_verified"] = user.EmailVerifiedAt != nil
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// OIDC 发现文档 公钥沿用 /.well-known/jwks.json
+func OpenIDConfiguration(c *gin.Context) {
+	issuer := strings.TrimSuffix(config.Config.OAuthConf.Issuer, "/")
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                config.Config.OAuthConf.Issuer,
+		"authorization_endpoint":                issuer + "/oauth2/authorize",
+		"token_endpoint":                        issuer + "/oauth2/token",
+		"introspection_endpoint":                issuer + "/oauth2/introspect",
+		"revocation_endpoint":                   issuer + "/oauth2/revoke",
+		"userinfo_endpoint":                     issuer + "/oauth2/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{model.GrantAuthorizationCode, model.GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{middleware.GetJWT().SigningAlg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{model.ScopeOpenID, model.ScopeProfile, model.ScopeEmail},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "amr", "preferred_username", "email", "email_verified"},
+	})
+}
@@ -0,0 +1,242 @@
+package logic
+
+import (
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// scope 的字符集 RFC 6749 3.3 的子集
+var scopeToken = regexp.MustCompile(`^[a-zA-Z0-9_.:/-]{1,64}$`)
+
+func toOAuthClientItem(o *model.OAuthClient) api.OAuthClientItem {
+	return api.OAuthClientItem{
+		ID:           o.ID,
+		ClientID:     o.ClientID,
+		Name:         o.Name,
+		RedirectURIs: o.RedirectURIList(),
+		Scopes:       o.ScopeList(),
+		GrantTypes:   strings.Fields(o.GrantTypes),
+		Public:       o.Public(),
+		CreatedAt:    o.CreatedAt,
+	}
+}
+
+// 校验注册参数 返回错误提示
+func validateOAuthClient(r *api.CreateOAuthClientRequest) string {
+	for _, g := range r.GrantTypes {
+		if g != model.GrantAuthorizationCode && g != model.GrantClientCredentials {
+			return "不支持的授权方式 " + g
+		}
+	}
+	if slices.Contains(r.GrantTypes, model.GrantClientCredentials) && r.Public {
+		return "公开客户端不能使用 client_credentials"
+	}
+	if slices.Contains(r.GrantTypes, model.GrantAuthorizationCode) && len(r.RedirectURIs) == 0 {
+		return "授权码方式需要回调地址"
+	}
+	for _, u := range r.RedirectURIs {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" || p.Fragment != "" || strings.ContainsAny(u, " \t\r\n") {
+			return "回调地址格式错误 " + u
+		}
+	}
+	for _, s := range r.Scopes {
+		if !scopeToken.MatchString(s) {
+			return "scope格式错误 " + s
+		}
+	}
+	if len(strings.Join(r.RedirectURIs, " ")) > 1024 || len(strings.Join(r.Scopes, " ")) > 512 {
+		return "回调地址或scope过多"
+	}
+	return ""
+}
+
+// 注册接入的应用 密钥只在此时返回一次
+func CreateOAuthClient(c *gin.Context) {
+	var r api.CreateOAuthClientRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	if msg := validateOAuthClient(&r); msg != "" {
+		c.JSON(http.StatusOK, pkg.FailWithMessage(pkg.ParamsErrCode, msg))
+		return
+	}
+	clientId, err := pkg.RandomToken(16)
+	if err != nil {
+		zap.S().Errorf("CreateOAuthClient.RandomToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	client := model.OAuthClient{
+		ClientID:     clientId,
+		Name:         r.Name,
+		RedirectURIs: strings.Join(slices.Compact(slices.Sorted(slices.Values(r.RedirectURIs))), " "),
+		Scopes:       strings.Join(slices.Compact(slices.Sorted(slices.Values(r.Scopes))), " "),
+		GrantTypes:   strings.Join(slices.Compact(slices.Sorted(slices.Values(r.GrantTypes))), " "),
+	}
+	var secret string
+	if !r.Public {
+		secret, err = pkg.RandomToken(32)
+		if err != nil {
+			zap.S().Errorf("CreateOAuthClient.RandomToken err:%v", err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+		client.SecretHash = pkg.HashToken(secret)
+	}
+	if err := config.DB.Create(&client).Error; err != nil {
+		zap.S().Errorf("CreateOAuthClient create name:%v err:%v", r.Name, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	operator, _ := middleware.CurrentUser(c)
+	zap.S().Infof("[OAuthClient] 注册应用 clientId:%v name:%v operator:%v", client.ClientID, client.Name, operator.Username)
+	c.JSON(http.StatusOK, pkg.SuccessWithData(api.CreateOAuthClientResponse{
+		OAuthClientItem: toOAuthClientItem(&client),
+		ClientSecret:    secret,
+	}))
+}
+
+func ListOAuthClients(c *gin.Context) {
+	var clients []model.OAuthClient
+	if err := config.DB.Order("id DESC").Find(&clients).Error; err != nil {
+		zap.S().Errorf("ListOAuthClients err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	list := make([]api.OAuthClientItem, 0, len(clients))
+	for i := range clients {
+		list = append(list, toOAuthClientItem(&clients[i]))
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(list))
+}
+
+// 删除应用 已签发的访问令牌在自省和 userinfo 中立即失效 用户的授权记录一并删除
+func DeleteOAuthClient(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	client := model.OAuthClient{}
+	err = config.DB.First(&client, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("DeleteOAuthClient query id:%v err:%v", id, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("client_id = ?", client.ClientID).Delete(&model.OAuthConsent{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&client).Error
+	})
+	if err != nil {
+		zap.S().Errorf("DeleteOAuthClient delete id:%v err:%v", id, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	operator, _ := middleware.CurrentUser(c)
+	zap.S().Infof("[OAuthClient] 删除应用 clientId:%v name:%v operator:%v", client.ClientID, client.Name, operator.Username)
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 当前用户已授权的应用
+func ListOAuthConsents(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	var consents []model.OAuthConsent
+	if err := config.DB.Where("user_id = ?", currentUser.UserID).Order("id").Find(&consents).Error; err != nil {
+		zap.S().Errorf("ListOAuthConsents userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	ids := make([]string, 0, len(consents))
+	for _, o := range consents {
+		ids = append(ids, o.ClientID)
+	}
+	var clients []model.OAuthClient
+	if err := config.DB.Where("client_id IN ?", ids).Find(&clients).Error; err != nil {
+		zap.S().Errorf("ListOAuthConsents query clients userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	names := make(map[string]string, len(clients))
+	for _, o := range clients {
+		names[o.ClientID] = o.Name
+	}
+	list := make([]api.OAuthConsentItem, 0, len(consents))
+	for _, o := range consents {
+		list = append(list, api.OAuthConsentItem{
+			ID:         o.ID,
+			ClientID:   o.ClientID,
+			ClientName: names[o.ClientID],
+			Scopes:     strings.Fields(o.Scopes),
+			UpdatedAt:  o.UpdatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(list))
+}
+
+// 撤销对应用的授权 下次登录该应用需要重新确认
+// 已签发的访问令牌有效期较短 不单独吊销
+func RevokeOAuthConsent(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	consent := model.OAuthConsent{}
+	err = config.DB.Where("id = ? AND user_id = ?", id, currentUser.UserID).First(&consent).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("RevokeOAuthConsent query id:%v err:%v", id, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 先吊销已签发给该应用的访问令牌 失败时保留授权记录 可以重试
+	if err := cache.RevokeOAuthClientTokens(c.Request.Context(), currentUser.UserID, consent.ClientID); err != nil {
+		zap.S().Errorf("RevokeOAuthConsent.RevokeOAuthClientTokens userId:%v clientId:%v err:%v", currentUser.UserID, consent.ClientID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 物理删除 之后可以重新授权
+	if err := config.DB.Unscoped().Delete(&consent).Error; err != nil {
+		zap.S().Errorf("RevokeOAuthConsent delete id:%v err:%v", id, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, currentUser.UserID, currentUser.Username, model.EventOAuthRevoke, consent.ClientID)
+	c.JSON(http.StatusOK, pkg.Success())
+}
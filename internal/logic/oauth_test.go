@@ -0,0 +1,202 @@
+package logic_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	oauthClientID    = "test-app"
+	oauthRedirectURI = "https://app.example.com/callback"
+	oauthVerifier    = "verifier-0123456789-0123456789-0123456789-abcdef"
+)
+
+// 注册一个公开客户端 只能使用授权码 + PKCE
+func createOAuthClient(t *testing.T) {
+	t.Helper()
+	err := config.DB.Create(&model.OAuthClient{
+		ClientID:     oauthClientID,
+		Name:         "Test App",
+		RedirectURIs: oauthRedirectURI,
+		Scopes:       "openid email profile",
+		GrantTypes:   model.GrantAuthorizationCode,
+	}).Error
+	if err != nil {
+		t.Fatalf("创建OAuth应用失败 err:%v", err)
+	}
+}
+
+// 发起授权并同意 返回授权码
+func authorizeCode(t *testing.T, env *testutil.Env, token string) string {
+	t.Helper()
+	q := url.Values{
+		"client_id":             {oauthClientID},
+		"redirect_uri":          {oauthRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid email"},
+		"state":                 {"st"},
+		"nonce":                 {"nc"},
+		"code_challenge":        {oidc.CodeChallenge(oauthVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	w := env.Do(http.MethodGet, "/oauth2/authorize?"+q.Encode(), "", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("授权请求失败 status:%v body:%s", w.Code, w.Body.String())
+	}
+	consent, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("确认页地址错误 err:%v", err)
+	}
+	r := env.JSON(t, http.MethodPost, "/oauth2/consent/"+consent.Query().Get("request"), `{"approve":true}`, token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("同意授权失败 code:%v", r.Code)
+	}
+	var resp api.OAuthConsentResponse
+	r.Decode(t, &resp)
+	back, err := url.Parse(resp.RedirectTo)
+	if err != nil {
+		t.Fatalf("回调地址错误 err:%v", err)
+	}
+	if back.Query().Get("state") != "st" || back.Query().Get("code") == "" {
+		t.Fatalf("回调地址缺少 state 或 code got:%v", resp.RedirectTo)
+	}
+	return back.Query().Get("code")
+}
+
+func exchangeCode(env *testutil.Env, code, verifier string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {model.GrantAuthorizationCode},
+		"client_id":     {oauthClientID},
+		"code":          {code},
+		"redirect_uri":  {oauthRedirectURI},
+		"code_verifier": {verifier},
+	}
+	return env.Do(http.MethodPost, "/oauth2/token", form.Encode(), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+}
+
+func tokenResponse(t *testing.T, w *httptest.ResponseRecorder) api.OAuthTokenResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("换取令牌失败 status:%v body:%s", w.Code, w.Body.String())
+	}
+	var resp api.OAuthTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析令牌响应失败 err:%v", err)
+	}
+	return resp
+}
+
+func oauthErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var e struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &e)
+	return e.Error
+}
+
+func userInfoStatus(env *testutil.Env, accessToken string) int {
+	return env.Do(http.MethodGet, "/oauth2/userinfo", "", map[string]string{"Authorization": "Bearer " + accessToken}).Code
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+	env := testutil.Setup(t)
+	createOAuthClient(t)
+	testutil.CreateUser(t, "liam", password)
+	loginAt := time.Now().Unix()
+	pair := env.Login(t, "liam", password)
+
+	code := authorizeCode(t, env, pair.AccessToken)
+	resp := tokenResponse(t, exchangeCode(env, code, oauthVerifier))
+	if resp.AccessToken == "" || resp.IDToken == "" {
+		t.Fatalf("缺少访问令牌或 id_token got:%+v", resp)
+	}
+	if status := userInfoStatus(env, resp.AccessToken); status != http.StatusOK {
+		t.Fatalf("userinfo status:%v", status)
+	}
+
+	// id_token 的 auth_time 为登录时间 而不是换取令牌的时间
+	parts := strings.Split(resp.IDToken, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("解析 id_token 失败 err:%v", err)
+	}
+	var claims struct {
+		Nonce    string `json:"nonce"`
+		AuthTime int64  `json:"auth_time"`
+	}
+	json.Unmarshal(payload, &claims)
+	if claims.Nonce != "nc" || claims.AuthTime < loginAt || claims.AuthTime > time.Now().Unix() {
+		t.Fatalf("id_token got:%+v loginAt:%v", claims, loginAt)
+	}
+
+	// 授权码只能使用一次
+	if w := exchangeCode(env, code, oauthVerifier); oauthErrorCode(t, w) != "invalid_grant" {
+		t.Fatalf("重复使用授权码应失败 status:%v body:%s", w.Code, w.Body.String())
+	}
+}
+
+func TestOAuthPKCEMismatch(t *testing.T) {
+	env := testutil.Setup(t)
+	createOAuthClient(t)
+	testutil.CreateUser(t, "mia", password)
+	pair := env.Login(t, "mia", password)
+
+	code := authorizeCode(t, env, pair.AccessToken)
+	wrong := strings.Repeat("x", 43)
+	if w := exchangeCode(env, code, wrong); oauthErrorCode(t, w) != "invalid_grant" {
+		t.Fatalf("错误的 code_verifier 应失败 status:%v body:%s", w.Code, w.Body.String())
+	}
+	// 校验失败的授权码同样作废
+	if w := exchangeCode(env, code, oauthVerifier); oauthErrorCode(t, w) != "invalid_grant" {
+		t.Fatalf("校验失败后授权码应失效 status:%v body:%s", w.Code, w.Body.String())
+	}
+}
+
+func TestRevokeOAuthConsent(t *testing.T) {
+	env := testutil.Setup(t)
+	createOAuthClient(t)
+	testutil.CreateUser(t, "noah", password)
+	pair := env.Login(t, "noah", password)
+
+	resp := tokenResponse(t, exchangeCode(env, authorizeCode(t, env, pair.AccessToken), oauthVerifier))
+	pending := authorizeCode(t, env, pair.AccessToken)
+
+	r := env.JSON(t, http.MethodGet, "/user/oauth/consents", "", pair.AccessToken)
+	var consents []api.OAuthConsentItem
+	r.Decode(t, &consents)
+	if len(consents) != 1 {
+		t.Fatalf("授权记录 got:%+v", consents)
+	}
+	r = env.JSON(t, http.MethodDelete, fmt.Sprintf("/user/oauth/consents/%v", consents[0].ID), "", pair.AccessToken)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("撤销授权失败 code:%v", r.Code)
+	}
+	if status := userInfoStatus(env, resp.AccessToken); status != http.StatusUnauthorized {
+		t.Fatalf("撤销授权后访问令牌应失效 status:%v", status)
+	}
+	// 撤销前签发但尚未使用的授权码
+	if w := exchangeCode(env, pending, oauthVerifier); oauthErrorCode(t, w) != "invalid_grant" {
+		t.Fatalf("撤销授权后授权码应失效 status:%v body:%s", w.Code, w.Body.String())
+	}
+
+	// 重新授权后签发的令牌不受影响
+	time.Sleep(time.Millisecond)
+	resp = tokenResponse(t, exchangeCode(env, authorizeCode(t, env, pair.AccessToken), oauthVerifier))
+	if status := userInfoStatus(env, resp.AccessToken); status != http.StatusOK {
+		t.Fatalf("重新授权后的访问令牌应可用 status:%v", status)
+	}
+}
@@ -0,0 +1,339 @@
+package logic
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 保存 state 的cookie 回调时校验 防止登录CSRF
+const oidcStateCookie = "oidc_state"
+
+func setOIDCStateCookie(c *gin.Context, state string, maxAge int) {
+	conf := config.Config.JWTConf.Cookie
+	// 从提供方跳回属于顶级导航 Lax 模式下会携带cookie
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, "/", conf.Domain, conf.Secure, true)
+}
+
+// 跳转到第三方登录页
+func OIDCLogin(c *gin.Context) {
+	provider, ok := oidc.Get(c.Param("provider"))
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	// state 防CSRF nonce 绑定 ID token verifier 用于 PKCE
+	var params [3]string
+	for i, n := range []int{32, 16, 32} {
+		v, err := pkg.RandomToken(n)
+		if err != nil {
+			zap.S().Errorf("OIDCLogin.RandomToken err:%v", err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+		params[i] = v
+	}
+	state, nonce, verifier := params[0], params[1], params[2]
+	expire := config.Config.OIDCConf.StateExpire
+	err := cache.SaveOIDCState(c.Request.Context(), state, &cache.OIDCState{
+		Provider: provider.Name,
+		Nonce:    nonce,
+		Verifier: verifier,
+	}, expire)
+	if err != nil {
+		zap.S().Errorf("OIDCLogin.SaveOIDCState provider:%v err:%v", provider.Name, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	u, err := provider.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		zap.S().Errorf("OIDCLogin.AuthCodeURL provider:%v err:%v", provider.Name, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	setOIDCStateCookie(c, state, int(expire.Seconds()))
+	c.Redirect(http.StatusFound, u)
+}
+
+// 第三方登录回调 换取身份后绑定或创建用户 并签发令牌
+func OIDCCallback(c *gin.Context) {
+	name := c.Param("provider")
+	provider, ok := oidc.Get(name)
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		zap.S().Warnf("OIDCCallback 提供方返回错误 provider:%v error:%v %v", name, e, c.Query("error_description"))
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	state, code := c.Query("state"), c.Query("code")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	if state == "" || code == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	setOIDCStateCookie(c, "", -1)
+	ctx := c.Request.Context()
+	s, err := cache.TakeOIDCState(ctx, state)
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("OIDCCallback.TakeOIDCState err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if s.Provider != name {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	identity, err := provider.Exchange(ctx, code, s.Verifier, s.Nonce)
+	if err != nil {
+		zap.S().Errorf("OIDCCallback.Exchange provider:%v err:%v", name, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCErrCode))
+		return
+	}
+	// 只信任提供方验证过的邮箱
+	if identity.Email == "" || !identity.EmailVerified {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserOIDCEmailErrCode))
+		return
+	}
+	user, errCode, err := linkOrCreateUser(c, name, identity)
+	if err != nil {
+		zap.S().Errorf("OIDCCallback.linkOrCreateUser provider:%v sub:%v err:%v", name, identity.Subject, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if errCode != pkg.SuccessCode {
+		c.JSON(http.StatusOK, pkg.Fail(errCode))
+		return
+	}
+	if user.Status == model.UserStatusDisabled {
+		recordEvent(c, user.ID, user.Username, model.EventLoginFailure, reasonDisabled)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserDisabledErrCode))
+		return
+	}
+	// 第三方登录同样需要完成两步验证
+	enabled, err := mfaEnabled(user.ID)
+	if err != nil {
+		zap.S().Errorf("OIDCCallback.mfaEnabled userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if enabled {
+		startMFALogin(c, user)
+		return
+	}
+	pair, err := issueTokenPair(c, user, "", false)
+	if err != nil {
+		zap.S().Errorf("OIDCCallback.issueTokenPair userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := middleware.SetAuthCookies(c, pair.AccessToken, pair.RefreshToken); err != nil {
+		zap.S().Errorf("OIDCCallback.SetAuthCookies userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventLoginSuccess, "oidc:"+name)
+	c.JSON(http.StatusOK, pkg.SuccessWithData(pair))
+}
+
+// 按绑定关系查找用户 没有绑定时按邮箱绑定到已有用户或创建新用户
+// 返回的用户已预加载角色和权限
+func linkOrCreateUser(c *gin.Context, provider string, identity *oidc.Identity) (*model.User, pkg.Code, error) {
+	ident := model.UserIdentity{}
+	err := config.DB.Where("provider = ? AND subject = ?", provider, identity.Subject).First(&ident).Error
+	if err == nil {
+		user, err := loadUserWithRoles(ident.UserID)
+		if err == nil {
+			return user, pkg.SuccessCode, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, err
+		}
+		// 用户已删除 清除失效的绑定后按新用户处理
+		if err := config.DB.Unscoped().Delete(&ident).Error; err != nil {
+			return nil, 0, err
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, 0, err
+	}
+
+	user := model.User{}
+	err = config.DB.Where("email = ?", identity.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, 0, err
+	}
+	ident = model.UserIdentity{Provider: provider, Subject: identity.Subject, Email: identity.Email}
+	if user.ID != 0 {
+		// 本地账号未验证邮箱 无法确认是邮箱的主人注册的 不自动绑定
+		if user.EmailVerifiedAt == nil {
+			return nil, pkg.UserEmailExistsErrCode, nil
+		}
+		ident.UserID = user.ID
+		if err := config.DB.Create(&ident).Error; err != nil {
+			return nil, 0, err
+		}
+		recordEvent(c, user.ID, user.Username, model.EventIdentityLink, provider)
+	} else {
+		username, err := uniqueUsername(c.Request.Context(), identity)
+		if err != nil {
+			return nil, 0, err
+		}
+		cache.BloomAddUsername(c.Request.Context(), username)
+		now := time.Now()
+		user = model.User{
+			Username:        username,
+			Email:           identity.Email,
+			Status:          model.UserStatusActive,
+			EmailVerifiedAt: &now,
+		}
+		err = config.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			ident.UserID = user.ID
+			return tx.Create(&ident).Error
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		cache.BloomAddUserID(c.Request.Context(), user.ID)
+		// 清除创建前可能缓存的"用户不存在"
+		if err := cache.DeleteUserInfo(c.Request.Context(), strconv.Itoa(int(user.ID))); err != nil {
+			zap.S().Errorf("linkOrCreateUser.DeleteUserInfo userId:%v err:%v", user.ID, err)
+		}
+		recordEvent(c, user.ID, user.Username, model.EventIdentityLink, provider)
+	}
+	u, err := loadUserWithRoles(user.ID)
+	return u, pkg.SuccessCode, err
+}
+
+var usernameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// 根据提供方的用户名或邮箱前缀生成未被占用的用户名
+func uniqueUsername(ctx context.Context, identity *oidc.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameInvalid.ReplaceAllString(base, "")
+	if len(base) > 32 {
+		base = base[:32]
+	}
+	if base == "" {
+		base = "user"
+	}
+	username := base
+	for i := 0; i < 5; i++ {
+		if !cache.BloomUsernameMayExist(ctx, username) {
+			return username, nil
+		}
+		var n int64
+		if err := config.DB.Model(&model.User{}).Where("username = ?", username).Count(&n).Error; err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return username, nil
+		}
+		suffix, err := pkg.RandomToken(3)
+		if err != nil {
+			return "", err
+		}
+		username = base + "_" + strings.ToLower(suffix)
+	}
+	return "", errors.New("生成用户名失败")
+}
+
+// 当前用户绑定的第三方身份
+func ListIdentities(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	var idents []model.UserIdentity
+	if err := config.DB.Where("user_id = ?", currentUser.UserID).Order("id").Find(&idents).Error; err != nil {
+		zap.S().Errorf("ListIdentities userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	list := make([]api.IdentityItem, 0, len(idents))
+	for _, i := range idents {
+		list = append(list, api.IdentityItem{ID: i.ID, Provider: i.Provider, Email: i.Email, CreatedAt: i.CreatedAt})
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(list))
+}
+
+// 解绑第三方身份 没有密码时至少保留一个绑定
+func UnlinkIdentity(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	identId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	ident := model.UserIdentity{}
+	err = config.DB.Where("id = ? AND user_id = ?", identId, currentUser.UserID).First(&ident).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("UnlinkIdentity query identId:%v err:%v", identId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	user := model.User{}
+	if err := config.DB.First(&user, currentUser.UserID).Error; err != nil {
+		zap.S().Errorf("UnlinkIdentity query user userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if user.Password == "" {
+		var n int64
+		if err := config.DB.Model(&model.UserIdentity{}).Where("user_id = ?", user.ID).Count(&n).Error; err != nil {
+			zap.S().Errorf("UnlinkIdentity count userId:%v err:%v", user.ID, err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+		if n <= 1 {
+			c.JSON(http.StatusOK, pkg.Fail(pkg.UserIdentityErrCode))
+			return
+		}
+	}
+	// 物理删除 之后可以重新绑定
+	if err := config.DB.Unscoped().Delete(&ident).Error; err != nil {
+		zap.S().Errorf("UnlinkIdentity delete identId:%v err:%v", identId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventIdentityUnlink, ident.Provider)
+	c.JSON(http.StatusOK, pkg.Success())
+}
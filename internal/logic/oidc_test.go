@@ -0,0 +1,168 @@
+package logic_test
+
+import (
+	"encoding/json"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// 提供方需要通过网络获取元数据和换取token 启动真实的http服务
+// 服务地址在初始化之前确定 用于填写 issuer 和回调地址
+type oidcEnv struct {
+	*testutil.Env
+	base   string
+	client *http.Client
+}
+
+func setupOIDC(t *testing.T, fake bool) *oidcEnv {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(nil)
+	base := "http://" + ts.Listener.Addr().String()
+	env := testutil.Setup(t, func(c *config.ServerConfig) {
+		c.OIDCConf.Fake = fake
+		c.OIDCConf.Providers = map[string]config.OIDCProviderConfig{
+			oidc.FakeName: {
+				Issuer:       base + "/oidc-fake",
+				ClientID:     "ginwebproject1",
+				ClientSecret: "fake-secret",
+				RedirectURL:  base + "/oauth/fake/callback",
+			},
+		}
+	})
+	ts.Config.Handler = env.Router
+	ts.Start()
+	t.Cleanup(ts.Close)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		// 逐步处理跳转 授权页需要追加参数
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &oidcEnv{Env: env, base: base, client: client}
+}
+
+func (e *oidcEnv) get(t *testing.T, u string) *http.Response {
+	t.Helper()
+	resp, err := e.client.Get(u)
+	if err != nil {
+		t.Fatalf("GET %v err:%v", u, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// 走完 登录跳转 -> 测试提供方授权 -> 回调 返回回调的响应
+func (e *oidcEnv) login(t *testing.T, email string, verified bool) testutil.Response {
+	t.Helper()
+	resp := e.get(t, e.base+"/oauth/fake/login")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("登录未跳转到提供方 status:%v", resp.StatusCode)
+	}
+	authorize, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("授权地址错误 err:%v", err)
+	}
+	q := authorize.Query()
+	q.Set("login_hint", email)
+	if !verified {
+		q.Set("email_verified", "false")
+	}
+	authorize.RawQuery = q.Encode()
+	resp = e.get(t, authorize.String())
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("提供方授权失败 status:%v", resp.StatusCode)
+	}
+	resp = e.get(t, resp.Header.Get("Location"))
+	var r testutil.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("回调响应不是json err:%v", err)
+	}
+	return r
+}
+
+func (e *oidcEnv) userInfo(t *testing.T, token string) model.User {
+	t.Helper()
+	r := e.JSON(t, http.MethodPost, "/user/info", "", token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("查询用户信息失败 code:%v", r.Code)
+	}
+	var u model.User
+	r.Decode(t, &u)
+	return u
+}
+
+func TestOIDCCreateUser(t *testing.T) {
+	env := setupOIDC(t, true)
+	r := env.login(t, "ivy.new@example.com", true)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("第三方登录失败 code:%v msg:%v", r.Code, r.Msg)
+	}
+	var pair api.TokenResponse
+	r.Decode(t, &pair)
+	u := env.userInfo(t, pair.AccessToken)
+	if u.Email != "ivy.new@example.com" || u.Username != "ivy.new" || u.EmailVerifiedAt == nil {
+		t.Fatalf("创建的用户 got:%+v", u)
+	}
+
+	// 再次登录使用已有的绑定
+	r = env.login(t, "ivy.new@example.com", true)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("再次登录失败 code:%v", r.Code)
+	}
+	r.Decode(t, &pair)
+	if again := env.userInfo(t, pair.AccessToken); again.ID != u.ID {
+		t.Fatalf("再次登录应为同一用户 got:%v want:%v", again.ID, u.ID)
+	}
+	var n int64
+	config.DB.Model(&model.UserIdentity{}).Where("user_id = ?", u.ID).Count(&n)
+	if n != 1 {
+		t.Fatalf("绑定数量 got:%v", n)
+	}
+}
+
+func TestOIDCLinkExistingUser(t *testing.T) {
+	env := setupOIDC(t, true)
+	existing := testutil.CreateUser(t, "jack", password)
+	r := env.login(t, existing.Email, true)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("第三方登录失败 code:%v msg:%v", r.Code, r.Msg)
+	}
+	var pair api.TokenResponse
+	r.Decode(t, &pair)
+	if u := env.userInfo(t, pair.AccessToken); u.ID != existing.ID {
+		t.Fatalf("应绑定到邮箱相同的已有用户 got:%v want:%v", u.ID, existing.ID)
+	}
+}
+
+func TestOIDCRejectUnverifiedEmail(t *testing.T) {
+	env := setupOIDC(t, true)
+	existing := testutil.CreateUser(t, "kate", password)
+	if r := env.login(t, existing.Email, false); r.Code != pkg.UserOIDCEmailErrCode {
+		t.Fatalf("未验证的邮箱应被拒绝 code:%v", r.Code)
+	}
+	var n int64
+	config.DB.Model(&model.UserIdentity{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("未验证的邮箱不应创建绑定 got:%v", n)
+	}
+}
+
+func TestOIDCFakeDisabled(t *testing.T) {
+	env := setupOIDC(t, false)
+	// 未开启时同名配置不能作为普通提供方 也不挂载测试提供方
+	if r := env.JSON(t, http.MethodGet, "/oauth/fake/login", "", ""); r.Code != pkg.RecordNotFoundErrCode {
+		t.Fatalf("未开启 oidc.fake 时不应提供登录 code:%v", r.Code)
+	}
+	if w := env.Do(http.MethodGet, "/oidc-fake/.well-known/openid-configuration", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("未开启 oidc.fake 时不应挂载测试提供方 status:%v", w.Code)
+	}
+}
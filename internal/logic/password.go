@@ -0,0 +1,180 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/mailer"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 更新密码并让该用户所有已签发的令牌失效 用户不存在时返回 gorm.ErrRecordNotFound
+func updatePassword(ctx context.Context, userId uint, password string) error {
+	hashed, err := pkg.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx := config.DB.Model(&model.User{}).Where("id = ?", userId).Update("password", hashed)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	if err := cache.RevokeUserTokens(ctx, userId); err != nil {
+		return err
+	}
+	return cache.DeleteUserInfo(ctx, strconv.Itoa(int(userId)))
+}
+
+// 登录状态下修改密码 需要校验旧密码
+// 成功后其他设备的登录全部失效 当前设备返回新的令牌对
+func ChangePassword(c *gin.Context) {
+	var r api.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	user, err := loadUserWithRoles(currentUser.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ChangePassword.loadUserWithRoles userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	err = pkg.CheckPassWord(user.Password, r.OldPassword)
+	if errors.Is(err, pkg.ErrPasswordMismatch) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserPasswordErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ChangePassword.CheckPassWord userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	err = updatePassword(c.Request.Context(), user.ID, r.NewPassword)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ChangePassword.updatePassword userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventPasswordChange, "change")
+	// 修改密码不改变当前登录的两步验证状态
+	pair, err := issueTokenPair(c, user, "", currentUser.MFA())
+	if err != nil {
+		zap.S().Errorf("ChangePassword.issueTokenPair userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := middleware.SetAuthCookies(c, pair.AccessToken, pair.RefreshToken); err != nil {
+		zap.S().Errorf("ChangePassword.SetAuthCookies userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(pair))
+}
+
+// 忘记密码 向邮箱发送一次性的重置链接
+// 无论邮箱是否存在都返回成功 防止枚举注册邮箱
+func ForgotPassword(c *gin.Context) {
+	var r api.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	user := model.User{}
+	tx := config.DB.Where("email = ?", r.Email).First(&user)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		zap.S().Errorf("ForgotPassword query user email:%v err:%v", r.Email, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if user.ID == 0 || user.Status == model.UserStatusDisabled {
+		c.JSON(http.StatusOK, pkg.Success())
+		return
+	}
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		zap.S().Errorf("ForgotPassword.RandomToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	expire := config.Config.PwdConf.ResetExpire
+	if err := cache.SavePasswordResetToken(c.Request.Context(), token, user.ID, expire); err != nil {
+		zap.S().Errorf("ForgotPassword.SavePasswordResetToken userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	link := config.Config.PwdConf.ResetURL + "?token=" + url.QueryEscape(token)
+	err = mailer.Send(c.Request.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "重置密码",
+		Body:    fmt.Sprintf("%s 你好:\n\n请在 %v 内打开以下链接重置密码:\n%s\n\n如果不是你本人操作 请忽略本邮件。", user.Username, expire, link),
+	})
+	// 发送失败同样返回成功 否则可以据此判断邮箱已注册
+	if err != nil {
+		zap.S().Errorf("ForgotPassword.mailer.Send userId:%v err:%v", user.ID, err)
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 使用邮件中的token重置密码 token只能使用一次 成功后所有登录失效
+func ResetPassword(c *gin.Context) {
+	var r api.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	userId, err := cache.TakePasswordResetToken(c.Request.Context(), r.Token)
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserResetTokenErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ResetPassword.TakePasswordResetToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 发送邮件后账号可能已被删除
+	user := model.User{}
+	err = config.DB.First(&user, userId).Error
+	if err == nil {
+		err = updatePassword(c.Request.Context(), userId, r.NewPassword)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("ResetPassword.updatePassword userId:%v err:%v", userId, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventPasswordChange, "reset")
+	c.JSON(http.StatusOK, pkg.Success())
+}
@@ -0,0 +1,32 @@
+package logic_test
+
+import (
+	"context"
+	"errors"
+	"ginwebproject1/internal/mailer"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+)
+
+// 发送总是失败的邮件发送器
+type failMailer struct{}
+
+func (failMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("smtp unavailable")
+}
+
+func TestForgotPasswordMailFailure(t *testing.T) {
+	env := testutil.Setup(t)
+	u := testutil.CreateUser(t, "oscar", password)
+	mailer.Default = failMailer{}
+	t.Cleanup(func() { mailer.Default = mailer.LogMailer{} })
+
+	// 已注册和未注册的邮箱返回相同的结果
+	for _, email := range []string{u.Email, "nobody@example.com"} {
+		if r := env.JSON(t, http.MethodPost, "/password/forgot", `{"email":"`+email+`"}`, ""); r.Code != pkg.SuccessCode {
+			t.Fatalf("邮件发送失败时不应暴露邮箱是否注册 email:%v code:%v", email, r.Code)
+		}
+	}
+}
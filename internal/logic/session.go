@@ -0,0 +1,67 @@
+package logic
+
+import (
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 当前用户的全部登录会话
+func ListSessions(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	sessions, err := cache.ListSessions(c.Request.Context(), currentUser.UserID)
+	if err != nil {
+		zap.S().Errorf("ListSessions.cache.ListSessions userId:%v err:%v", currentUser.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	list := make([]api.SessionItem, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, api.SessionItem{
+			ID:        s.ID,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			LastIP:    s.LastIP,
+			MFA:       s.MFA,
+			Current:   s.ID == currentUser.SessionID,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+		})
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(list))
+}
+
+// 结束指定会话 该设备的refresh token和access token立即失效
+func RevokeSession(c *gin.Context) {
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	sid := c.Param("id")
+	ok, err := cache.RevokeSession(c.Request.Context(), currentUser.UserID, sid)
+	if err != nil {
+		zap.S().Errorf("RevokeSession.cache.RevokeSession userId:%v sid:%v err:%v", currentUser.UserID, sid, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 不存在或属于其他用户
+	if !ok {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
+		return
+	}
+	// 结束的是当前会话 同时清除cookie
+	if sid == currentUser.SessionID {
+		middleware.ClearAuthCookies(c)
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
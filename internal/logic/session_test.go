@@ -0,0 +1,104 @@
+package logic_test
+
+import (
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+)
+
+func listSessions(t *testing.T, env *testutil.Env, token string) []api.SessionItem {
+	t.Helper()
+	r := env.JSON(t, http.MethodGet, "/user/sessions", "", token)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("查询会话失败 code:%v", r.Code)
+	}
+	var sessions []api.SessionItem
+	r.Decode(t, &sessions)
+	return sessions
+}
+
+// 返回另一个会话的id
+func otherSession(t *testing.T, sessions []api.SessionItem) string {
+	t.Helper()
+	for _, s := range sessions {
+		if !s.Current {
+			return s.ID
+		}
+	}
+	t.Fatalf("没有其他会话 got:%+v", sessions)
+	return ""
+}
+
+func TestRevokeSession(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "yara", password)
+	phone := env.Login(t, "yara", password)
+	laptop := env.Login(t, "yara", password)
+
+	sessions := listSessions(t, env, phone.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("会话数量 got:%v", len(sessions))
+	}
+	sid := otherSession(t, sessions)
+	if r := env.JSON(t, http.MethodDelete, "/user/sessions/"+sid, "", phone.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("结束会话失败 code:%v", r.Code)
+	}
+
+	// 被结束的设备 access token 和 refresh token 都失效
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", laptop.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("结束会话后 access token 应失效")
+	}
+	if _, code := refresh(t, env, laptop.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("结束会话后 refresh token 应失效 code:%v", code)
+	}
+	// 其他会话不受影响
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", phone.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("其他会话的 access token 不应失效 code:%v", r.Code)
+	}
+	pair, code := refresh(t, env, phone.RefreshToken)
+	if code != pkg.SuccessCode {
+		t.Fatalf("其他会话的 refresh token 不应失效 code:%v", code)
+	}
+	if sessions := listSessions(t, env, pair.AccessToken); len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("结束后剩余的会话 got:%+v", sessions)
+	}
+}
+
+func TestRevokeSessionOtherUser(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "zack", password)
+	testutil.CreateUser(t, "zoe", password)
+	zack := env.Login(t, "zack", password)
+	zoe := env.Login(t, "zoe", password)
+
+	sid := listSessions(t, env, zoe.AccessToken)[0].ID
+	if r := env.JSON(t, http.MethodDelete, "/user/sessions/"+sid, "", zack.AccessToken); r.Code != pkg.RecordNotFoundErrCode {
+		t.Fatalf("不能结束其他用户的会话 code:%v", r.Code)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", zoe.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("其他用户的会话不应失效 code:%v", r.Code)
+	}
+}
+
+func TestListSessionsPrunesStale(t *testing.T) {
+	env := testutil.Setup(t)
+	u := testutil.CreateUser(t, "amy", password)
+	current := env.Login(t, "amy", password)
+	env.Login(t, "amy", password)
+
+	// 模拟 refresh token 家族已过期 会话信息仍在
+	sid := otherSession(t, listSessions(t, env, current.AccessToken))
+	env.Redis.Del("s:ginwebproject1:refresh_family:" + sid)
+
+	sessions := listSessions(t, env, current.AccessToken)
+	if len(sessions) != 1 || sessions[0].ID == sid {
+		t.Fatalf("已失效的会话不应列出 got:%+v", sessions)
+	}
+	familyKey := fmt.Sprintf("se:ginwebproject1:user_refresh_family:%v", u.ID)
+	if ok, _ := env.Redis.SIsMember(familyKey, sid); ok {
+		t.Fatalf("已失效的会话应从用户的家族集合中移除")
+	}
+}
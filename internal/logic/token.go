@@ -0,0 +1,210 @@
+package logic
+
+import (
+	"errors"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/pkg"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 签发短期 access token 和长期 refresh token
+// user 需要预加载 Roles.Permissions 角色和权限会写入 access token
+// family 为空时表示一次新的登录 会生成新的token家族并记录为新会话 否则延续原会话
+// mfa 表示本次登录通过了两步验证 写入 amr 并随 refresh token 保留
+func issueTokenPair(c *gin.Context, user *model.User, family string, mfa bool) (*api.TokenResponse, error) {
+	ctx := c.Request.Context()
+	refreshExpire := config.Config.JWTConf.RefreshExpire
+	var err error
+	if family == "" {
+		family, err = pkg.RandomToken(16)
+		if err != nil {
+			return nil, err
+		}
+		err = cache.CreateSession(ctx, &cache.Session{
+			ID:        family,
+			UserID:    user.ID,
+			UserAgent: c.Request.UserAgent(),
+			IP:        c.ClientIP(),
+			MFA:       mfa,
+			CreatedAt: time.Now(),
+		}, refreshExpire)
+	} else {
+		err = cache.TouchSession(ctx, family, c.ClientIP(), refreshExpire)
+	}
+	if err != nil {
+		return nil, err
+	}
+	accessExpire := config.Config.JWTConf.AccessExpire
+	j := middleware.GetJWT()
+	roles, perms := user.RoleNames()
+	amr := []string{middleware.AMRPassword}
+	if mfa {
+		amr = append(amr, middleware.AMRMFA)
+	}
+	claims := &middleware.Claims{
+		UserID:    user.ID,       // 用户ID
+		Username:  user.Username, //用户名
+		Roles:     roles,         // 角色
+		Perms:     perms,         // 权限
+		AMR:       amr,           // 认证方式
+		SessionID: family,        // 会话
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(accessExpire).Unix(), //期限
+		},
+	}
+	accessToken, err := j.GenerateJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := pkg.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	err = cache.SaveRefreshToken(ctx, refreshToken, cache.RefreshToken{
+		UserID:   user.ID,
+		Username: user.Username,
+		Family:   family,
+		MFA:      mfa,
+	}, refreshExpire)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessExpire.Seconds()),
+	}, nil
+}
+
+// 使用 refresh token 换取新的令牌对 旧的 refresh token 随即失效
+func Refresh(c *gin.Context) {
+	var r api.RefreshRequest
+	// 请求体可以为空
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+			return
+		}
+	}
+	if r.RefreshToken == "" {
+		// cookie模式 浏览器自动携带cookie 需要校验CSRF token
+		r.RefreshToken = middleware.RefreshTokenFromCookie(c)
+		if r.RefreshToken == "" {
+			c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+			return
+		}
+		if !middleware.CheckCSRF(c) {
+			c.JSON(http.StatusForbidden, pkg.Fail(pkg.UserCSRFErrCode))
+			return
+		}
+	}
+	rt, err := cache.UseRefreshToken(c.Request.Context(), r.RefreshToken)
+	if errors.Is(err, cache.ErrRefreshTokenReused) {
+		// 已轮换的token被重复使用 整个家族已被吊销
+		zap.S().Warnf("Refresh refresh token 重复使用 userId:%v family:%v ip:%v", rt.UserID, rt.Family, c.ClientIP())
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserRefreshErrCode))
+		return
+	}
+	if errors.Is(err, cache.ErrRefreshTokenInvalid) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserRefreshErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("Refresh.cache.UseRefreshToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 重新读取用户 使角色变更在刷新后生效 用户已删除时拒绝刷新
+	user, err := loadUserWithRoles(rt.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserRefreshErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("Refresh.loadUserWithRoles userId:%v err:%v", rt.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if user.Status == model.UserStatusDisabled {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserDisabledErrCode))
+		return
+	}
+	pair, err := issueTokenPair(c, user, rt.Family, rt.MFA)
+	if err != nil {
+		zap.S().Errorf("Refresh.issueTokenPair userId:%v err:%v", rt.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := middleware.SetAuthCookies(c, pair.AccessToken, pair.RefreshToken); err != nil {
+		zap.S().Errorf("Refresh.SetAuthCookies userId:%v err:%v", rt.UserID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessWithData(pair))
+}
+
+// 注销当前 access token 并吊销传入的 refresh token
+func Logout(c *gin.Context) {
+	var r api.LogoutRequest
+	// 请求体可以为空
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+			return
+		}
+	}
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+		return
+	}
+	jti := currentUser.Id
+	ttl := time.Until(time.Unix(currentUser.ExpiresAt, 0))
+	if err := cache.DenyAccessToken(c.Request.Context(), jti, ttl); err != nil {
+		zap.S().Errorf("Logout.cache.DenyAccessToken jti:%v err:%v", jti, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 结束当前会话 未携带refresh token时同样生效
+	if currentUser.SessionID != "" {
+		if err := cache.RevokeRefreshFamily(c.Request.Context(), currentUser.SessionID); err != nil {
+			zap.S().Errorf("Logout.cache.RevokeRefreshFamily jti:%v err:%v", jti, err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+	}
+	if r.RefreshToken == "" {
+		r.RefreshToken = middleware.RefreshTokenFromCookie(c)
+	}
+	if r.RefreshToken != "" {
+		if err := cache.RevokeRefreshToken(c.Request.Context(), r.RefreshToken); err != nil {
+			zap.S().Errorf("Logout.cache.RevokeRefreshToken jti:%v err:%v", jti, err)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
+	}
+	middleware.ClearAuthCookies(c)
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 公开签名公钥 其他服务据此验证token 无需共享密钥文件
+func JWKS(c *gin.Context) {
+	jwks, err := middleware.GetJWT().JWKS()
+	if err != nil {
+		zap.S().Errorf("JWKS err:%v", err)
+		c.JSON(http.StatusInternalServerError, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
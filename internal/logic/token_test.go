@@ -0,0 +1,119 @@
+package logic_test
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"testing"
+)
+
+const password = "Passw0rd!Test"
+
+func refresh(t *testing.T, env *testutil.Env, token string) (api.TokenResponse, pkg.Code) {
+	t.Helper()
+	r := env.JSON(t, http.MethodPost, "/token/refresh", fmt.Sprintf(`{"refresh_token":%q}`, token), "")
+	var pair api.TokenResponse
+	if r.Code == pkg.SuccessCode {
+		r.Decode(t, &pair)
+	}
+	return pair, r.Code
+}
+
+func TestRefreshRotation(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "alice", password)
+	first := env.Login(t, "alice", password)
+
+	second, code := refresh(t, env, first.RefreshToken)
+	if code != pkg.SuccessCode {
+		t.Fatalf("刷新失败 code:%v", code)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatalf("刷新后没有轮换 refresh token")
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", second.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("新的 access token 不可用 code:%v", r.Code)
+	}
+
+	// 已轮换的token再次使用 吊销整个家族
+	if _, code := refresh(t, env, first.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("重复使用 refresh token 应失败 code:%v", code)
+	}
+	if _, code := refresh(t, env, second.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("家族被吊销后 refresh token 应失效 code:%v", code)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", second.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("会话结束后 access token 应失效")
+	}
+}
+
+func TestRefreshUnknownToken(t *testing.T) {
+	env := testutil.Setup(t)
+	if _, code := refresh(t, env, "not-a-token"); code != pkg.UserRefreshErrCode {
+		t.Fatalf("不存在的 refresh token 应失败 code:%v", code)
+	}
+	if _, err := cache.UseRefreshToken(context.Background(), "not-a-token"); err != cache.ErrRefreshTokenInvalid {
+		t.Fatalf("UseRefreshToken err:%v", err)
+	}
+	// 不存在的token不能被重新创建出没有ttl的记录
+	if env.Redis.Exists("hs:ginwebproject1:refresh:" + pkg.HashToken("not-a-token")) {
+		t.Fatalf("残留了没有ttl的 refresh token 记录")
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "bob", password)
+	pair := env.Login(t, "bob", password)
+
+	r := env.JSON(t, http.MethodPost, "/user/logout", fmt.Sprintf(`{"refresh_token":%q}`, pair.RefreshToken), pair.AccessToken)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("登出失败 code:%v", r.Code)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", pair.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("登出后 access token 应失效")
+	}
+	if _, code := refresh(t, env, pair.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("登出后 refresh token 应失效 code:%v", code)
+	}
+}
+
+func TestRevokeUserTokensSameSecond(t *testing.T) {
+	env := testutil.Setup(t)
+	u := testutil.CreateUser(t, "carol", password)
+	pair := env.Login(t, "carol", password)
+	// 紧接着吊销 与签发在同一秒内
+	if err := cache.RevokeUserTokens(context.Background(), u.ID); err != nil {
+		t.Fatalf("RevokeUserTokens err:%v", err)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", pair.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("吊销前签发的 access token 应失效")
+	}
+}
+
+func TestChangePasswordReissuesTokens(t *testing.T) {
+	env := testutil.Setup(t)
+	testutil.CreateUser(t, "dave", password)
+	old := env.Login(t, "dave", password)
+
+	body := fmt.Sprintf(`{"old_password":%q,"new_password":"N3w-Passw0rd!x"}`, password)
+	r := env.JSON(t, http.MethodPost, "/user/password", body, old.AccessToken)
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("修改密码失败 code:%v msg:%v", r.Code, r.Msg)
+	}
+	var pair api.TokenResponse
+	r.Decode(t, &pair)
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", pair.AccessToken); r.Code != pkg.SuccessCode {
+		t.Fatalf("修改密码后签发的 access token 应可用 code:%v", r.Code)
+	}
+	if r := env.JSON(t, http.MethodPost, "/user/info", "", old.AccessToken); r.Code == pkg.SuccessCode {
+		t.Fatalf("修改密码前的 access token 应失效")
+	}
+	if _, code := refresh(t, env, old.RefreshToken); code != pkg.UserRefreshErrCode {
+		t.Fatalf("修改密码前的 refresh token 应失效 code:%v", code)
+	}
+}
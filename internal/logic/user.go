@@ -10,11 +10,8 @@ import (
 	"ginwebproject1/pkg"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
-	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -30,20 +27,29 @@ func Register(c *gin.Context) {
 		return
 	}
 	// 逻辑请求
+	hashed, err := pkg.HashPassword(r.Password)
+	if err != nil {
+		zap.S().Errorf("Register.HashPassword err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
 	u := model.User{
 		Username: r.UserName,
-		Password: pkg.HashPassword(r.Password),
+		Password: hashed,
 		Email:    r.Email,
+		Status:   model.UserStatusPending, // 验证邮箱后变为 active
 	}
 
-	// 1. 处理重复名字情况
+	// 1. 处理重复名字情况 布隆过滤器判断不存在时不查询数据库
 	var user model.User
-	tx := config.DB.Where("username = ?", u.Username).First(&user)
-	// 处理未找到以外的错误
-	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-		zap.S().Errorf("Register queru user email:%v err:%v", u.Username, tx.Error)
-		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
-		return // 提前退出
+	if cache.BloomUsernameMayExist(c.Request.Context(), u.Username) {
+		tx := config.DB.Where("username = ?", u.Username).First(&user)
+		// 处理未找到以外的错误
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			zap.S().Errorf("Register queru user email:%v err:%v", u.Username, tx.Error)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return // 提前退出
+		}
 	}
 	// 处理用户名已存在
 	if user.ID != 0 {
@@ -55,7 +61,7 @@ func Register(c *gin.Context) {
 	// 2. 处理相同邮箱情况
 	// 重置 如果第一次查用户名时 user.Id != 0 user.Id != 0 永远为 true
 	user = model.User{}
-	tx = config.DB.Where("email = ?", u.Email).First(&user)
+	tx := config.DB.Where("email = ?", u.Email).First(&user)
 	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
 		zap.S().Errorf("Register queru user email:%v err:%v", u.Email, tx.Error)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
@@ -68,13 +74,27 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// 无错误则注册
+	// 无错误则注册 用户名先写入布隆过滤器 避免并发注册同名用户时判断为不存在
+	cache.BloomAddUsername(c.Request.Context(), u.Username)
 	tx = config.DB.Create(&u)
 	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
 		zap.S().Errorf("Register Create user:%+v err:%v", u, tx.Error)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
 		return
 	}
+	cache.BloomAddUserID(c.Request.Context(), u.ID)
+	// 清除注册前可能缓存的"用户不存在"
+	if err := cache.DeleteUserInfo(c.Request.Context(), strconv.Itoa(int(u.ID))); err != nil {
+		zap.S().Errorf("Register.DeleteUserInfo userId:%v err:%v", u.ID, err)
+	}
+	// 发送验证邮件 失败时用户可以通过重发接口再次获取
+	_, err = cache.AcquireEmailVerifySend(c.Request.Context(), u.ID, config.Config.RegConf.ResendInterval)
+	if err == nil {
+		err = sendVerifyEmail(c.Request.Context(), &u)
+	}
+	if err != nil {
+		zap.S().Errorf("Register.sendVerifyEmail userId:%v err:%v", u.ID, err)
+	}
 	c.JSON(http.StatusOK, pkg.Success())
 }
 
@@ -84,88 +104,134 @@ func Login(c *gin.Context) {
 	err := c.ShouldBindJSON(&r)
 	if err != nil {
 		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	// 连续失败过多 处于锁定或退避中
+	if loginLocked(c, r.Username) {
+		return
 	}
 	// 进入逻辑处理 查询用于书否在数据库内
 	user := model.User{
 		Username: r.Username,
 	}
-	tx := config.DB.Where("username = ?", user.Username).First(&user)
-	// 出现未查询到用户以外 的错误
-	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-		zap.S().Errorf("从数据库中查找用户 <%s>失败 err:%v", user.Username, tx.Error)
-		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
-		return
+	// 同时加载角色和权限 写入token 布隆过滤器判断不存在时不查询数据库
+	if cache.BloomUsernameMayExist(c.Request.Context(), r.Username) {
+		tx := config.DB.Preload("Roles.Permissions").Where("username = ?", user.Username).First(&user)
+		// 出现未查询到用户以外 的错误
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			zap.S().Errorf("从数据库中查找用户 <%s>失败 err:%v", user.Username, tx.Error)
+			c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			return
+		}
 	}
 	// 用户不存在的情况
 	if user.ID == 0 {
+		loginFailed(c, 0, r.Username, reasonUserNotFound)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
 		return
 	}
 	// 存在 密码匹配
-	if pkg.CheckPassWord(user.Password, r.Password) != nil {
+	err = pkg.CheckPassWord(user.Password, r.Password)
+	if errors.Is(err, pkg.ErrPasswordMismatch) {
+		loginFailed(c, user.ID, r.Username, reasonBadPassword)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.UserPasswordErrCode))
 		return
 	}
-	// 成功 创建jwt
-	j := middleware.NewJWT()
-	// 每次登录创建新的token 防止token永久有效
-	claims := jwt.MapClaims{
-		"sub":      user.ID,                               // 用户ID
-		"username": user.Username,                         //用户名
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), //期限
+	if err != nil {
+		zap.S().Errorf("Login.CheckPassWord userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 密码正确 清除失败计数
+	if err := cache.ResetLoginFailures(c.Request.Context(), r.Username); err != nil {
+		zap.S().Errorf("Login.ResetLoginFailures username:%v err:%v", r.Username, err)
+	}
+	// 账号已被禁用
+	if user.Status == model.UserStatusDisabled {
+		recordEvent(c, user.ID, user.Username, model.EventLoginFailure, reasonDisabled)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserDisabledErrCode))
+		return
+	}
+	// 按配置拒绝未验证邮箱的账号
+	if user.Status == model.UserStatusPending && config.Config.RegConf.RequireVerification {
+		recordEvent(c, user.ID, user.Username, model.EventLoginFailure, reasonNotVerified)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserNotVerifiedErrCode))
+		return
+	}
+	// 旧算法或旧参数的哈希 使用当前算法重新哈希 失败不影响登录
+	// 放在状态检查之后 被禁用的账号不产生写入
+	if pkg.NeedsRehash(user.Password) {
+		rehashPassword(&user, r.Password)
 	}
-	tokenString, err := j.GenerateJWT(claims)
+	// 开启了两步验证 先返回短期的待验证token 由 /login/mfa 换取正式令牌
+	enabled, err := mfaEnabled(user.ID)
 	if err != nil {
-		zap.S().Infof("[CreateToken] 生成token失败")
+		zap.S().Errorf("Login.mfaEnabled userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if enabled {
+		startMFALogin(c, &user)
+		return
+	}
+	// 成功 签发短期access token和可轮换的refresh token
+	pair, err := issueTokenPair(c, &user, "", false)
+	if err != nil {
+		zap.S().Errorf("[CreateToken] 生成token失败 err:%v", err)
 		// gin.H  map[string]interface{}简写
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"msg": "生成token失败",
 		})
 		return
 	}
-	c.JSON(http.StatusOK, pkg.SuccessWithData(tokenString))
+	// cookie模式下同时写入cookie
+	if err := middleware.SetAuthCookies(c, pair.AccessToken, pair.RefreshToken); err != nil {
+		zap.S().Errorf("Login.SetAuthCookies userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	recordEvent(c, user.ID, user.Username, model.EventLoginSuccess, "password")
+	c.JSON(http.StatusOK, pkg.SuccessWithData(pair))
+}
+
+// 登录成功后把密码升级为当前算法的哈希
+func rehashPassword(user *model.User, password string) {
+	hashed, err := pkg.HashPassword(password)
+	if err != nil {
+		zap.S().Errorf("rehashPassword.HashPassword userId:%v err:%v", user.ID, err)
+		return
+	}
+	tx := config.DB.Model(&model.User{}).Where("id = ? AND password = ?", user.ID, user.Password).Update("password", hashed)
+	if tx.Error != nil {
+		zap.S().Errorf("rehashPassword update userId:%v err:%v", user.ID, tx.Error)
+		return
+	}
+	user.Password = hashed
 }
 
 func Info(c *gin.Context) {
 	// 根据jwt取出用户信息
-	claims, ok := c.Get("claims")
+	currentUser, ok := middleware.CurrentUser(c)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"msg": "未登录"})
 		c.Abort()
 		return
 	}
-	currentUser, ok := claims.(jwt.MapClaims)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"msg": "claims 类型断言失败"})
-		return
-	}
 
 	// 先获取用户数据库中的id
-	userId := currentUser["sub"].(float64)
+	userId := currentUser.UserID
 
-	if userId == 0 {
-		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
-		return
-	}
-	// 查询缓存
+	// 依次查询本地缓存、redis 都没有命中时查数据库并写回缓存
 	u, err := cache.GetUserInfo(c.Request.Context(), strconv.Itoa(int(userId)))
 	// 处理查询为空的情况
-	if err != nil && !errors.Is(err, redis.Nil) {
-		zap.S().Errorf("Info.cache.GetUserInfo  userId:%+v err:%v", userId, err)
-		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
-		return
-	}
-	// 查询存在的情况
-	if u != nil {
-		c.JSON(http.StatusOK, pkg.SuccessWithData(u))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.RecordNotFoundErrCode))
 		return
 	}
-	// 缓存中没有命中，就刷新缓存（查数据库）
-	// 内部会调用数据库查询，并把查询结果写入 Redis 缓存
-	u, err = cache.RefreshUserInfo(c.Request.Context(), strconv.Itoa(int(userId)))
 	if err != nil {
-		zap.S().Errorf("Info.refreshUserInfoCache  user:%+v err:%v", userId, err)
+		zap.S().Errorf("Info.cache.GetUserInfo  userId:%+v err:%v", userId, err)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
 	}
 
 	c.JSON(http.StatusOK, pkg.SuccessWithData(u))
@@ -181,22 +247,27 @@ func Update(c *gin.Context) {
 		return
 	}
 	// 或取claims中的id 根据id修改username
-	claims, _ := c.Get("claims")
-	currentUser := claims.(jwt.MapClaims)
-	userId := currentUser["sub"].(float64)
-	if userId == 0 {
-		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
 		return
 	}
+	userId := currentUser.UserID
 	user := model.User{}
 	config.DB.Where("id=?", userId).First(&user)
-	// 更新
+	oldUsername := user.Username
+	// 更新 新用户名先写入布隆过滤器 旧用户名无法删除 计入待重建数量
+	cache.BloomAddUsername(c.Request.Context(), r.Username)
 	tx := config.DB.Model(&user).Update("username", r.Username)
 	if tx.Error != nil {
 		zap.S().Errorf("Update  user:%+v err:%v", user, tx.Error)
 		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
 		return
 	}
+	if oldUsername != r.Username {
+		cache.BloomUserRemoved(c.Request.Context())
+	}
+	recordEvent(c, user.ID, r.Username, model.EventUsernameChange, oldUsername+" -> "+r.Username)
 	// 刷新redis缓存
 	_, err = cache.RefreshUserInfo(c.Request.Context(), strconv.Itoa(int(userId)))
 	if err != nil {
@@ -209,14 +280,12 @@ func Update(c *gin.Context) {
 
 func Delete(c *gin.Context) {
 	// 根据claims中的id
-	claims, _ := c.Get("claims")
-	curentUser := claims.(jwt.MapClaims)
-	userID := curentUser["sub"].(float64)
-
-	if userID == 0 {
-		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+	currentUser, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
 		return
 	}
+	userID := currentUser.UserID
 	// 删除redis 和 数据库中的用户
 	// 依旧先获取用户信息 再执行操作
 	u := model.User{}
@@ -229,6 +298,9 @@ func Delete(c *gin.Context) {
 		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
 		return
 	}
+	recordEvent(c, u.ID, u.Username, model.EventAccountDelete, "")
+	// 布隆过滤器无法删除 计入待重建数量
+	cache.BloomUserRemoved(c.Request.Context())
 	// 删除redis中的用户
 	err := cache.DeleteUserInfo(c.Request.Context(), strconv.Itoa(int(userID)))
 	if err != nil {
@@ -236,5 +308,12 @@ func Delete(c *gin.Context) {
 		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
 		return
 	}
+	// 吊销该用户已签发的全部令牌
+	err = cache.RevokeUserTokens(c.Request.Context(), userID)
+	if err != nil {
+		zap.S().Errorf("Delete.RevokeUserTokens  userId:%v err:%v", u.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
 	c.JSON(http.StatusOK, pkg.Success())
 }
@@ -0,0 +1,116 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/mailer"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 生成邮箱验证token并发送验证邮件
+func sendVerifyEmail(ctx context.Context, user *model.User) error {
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	conf := config.Config.RegConf
+	if err := cache.SaveEmailVerifyToken(ctx, token, user.ID, conf.VerifyExpire); err != nil {
+		return err
+	}
+	link := conf.VerifyURL + "?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "验证邮箱",
+		Body:    fmt.Sprintf("%s 你好:\n\n请在 %v 内打开以下链接完成邮箱验证:\n%s\n\n如果不是你本人注册 请忽略本邮件。", user.Username, conf.VerifyExpire, link),
+	})
+}
+
+// 验证邮箱 待验证的账号变为正常状态
+func VerifyEmail(c *gin.Context) {
+	var r api.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	userId, err := cache.TakeEmailVerifyToken(c.Request.Context(), r.Token)
+	if errors.Is(err, redis.Nil) {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.UserVerifyErrCode))
+		return
+	}
+	if err != nil {
+		zap.S().Errorf("VerifyEmail.TakeEmailVerifyToken err:%v", err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	now := time.Now()
+	tx := config.DB.Model(&model.User{}).Where("id = ?", userId).Update("email_verified_at", now)
+	if tx.Error != nil {
+		zap.S().Errorf("VerifyEmail update email_verified_at userId:%v err:%v", userId, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 只激活待验证的账号 不会解除管理员的禁用
+	tx = config.DB.Model(&model.User{}).
+		Where("id = ? AND status = ?", userId, model.UserStatusPending).
+		Update("status", model.UserStatusActive)
+	if tx.Error != nil {
+		zap.S().Errorf("VerifyEmail update status userId:%v err:%v", userId, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if err := cache.DeleteUserInfo(c.Request.Context(), strconv.Itoa(int(userId))); err != nil {
+		zap.S().Errorf("VerifyEmail.DeleteUserInfo userId:%v err:%v", userId, err)
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
+
+// 重新发送验证邮件 同一账号在 resend_interval 内只发送一次
+// 邮箱不存在、已验证或发送过于频繁时同样返回成功 防止枚举注册邮箱
+func ResendVerifyEmail(c *gin.Context) {
+	var r api.ResendVerifyEmailRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusOK, pkg.Fail(pkg.ParamsErrCode))
+		return
+	}
+	user := model.User{}
+	tx := config.DB.Where("email = ?", r.Email).First(&user)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		zap.S().Errorf("ResendVerifyEmail query user email:%v err:%v", r.Email, tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	if user.ID == 0 || user.EmailVerifiedAt != nil {
+		c.JSON(http.StatusOK, pkg.Success())
+		return
+	}
+	ok, err := cache.AcquireEmailVerifySend(c.Request.Context(), user.ID, config.Config.RegConf.ResendInterval)
+	if err != nil {
+		zap.S().Errorf("ResendVerifyEmail.AcquireEmailVerifySend userId:%v err:%v", user.ID, err)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		return
+	}
+	// 发送过于频繁或发送失败时同样返回成功 否则可以据此判断邮箱已注册且未验证
+	if !ok {
+		zap.S().Infof("[VerifyEmailThrottled] 重新发送过于频繁 userId:%v", user.ID)
+		c.JSON(http.StatusOK, pkg.Success())
+		return
+	}
+	if err := sendVerifyEmail(c.Request.Context(), &user); err != nil {
+		zap.S().Errorf("ResendVerifyEmail.sendVerifyEmail userId:%v err:%v", user.ID, err)
+	}
+	c.JSON(http.StatusOK, pkg.Success())
+}
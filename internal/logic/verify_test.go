@@ -0,0 +1,63 @@
+package logic_test
+
+import (
+	"context"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/mailer"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// 记录发送的邮件
+type recordMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *recordMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *recordMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent)
+}
+
+// 创建一个已注册但邮箱未验证的用户
+func createPendingUser(t *testing.T, username string) model.User {
+	t.Helper()
+	u := testutil.CreateUser(t, username, password)
+	err := config.DB.Model(&u).Updates(map[string]any{"status": model.UserStatusPending, "email_verified_at": nil}).Error
+	if err != nil {
+		t.Fatalf("修改为待验证状态失败 err:%v", err)
+	}
+	u.Status = model.UserStatusPending
+	u.EmailVerifiedAt = nil
+	return u
+}
+
+func TestResendVerifyEmailThrottle(t *testing.T) {
+	env := testutil.Setup(t)
+	u := createPendingUser(t, "penny")
+	m := &recordMailer{}
+	mailer.Default = m
+	t.Cleanup(func() { mailer.Default = mailer.LogMailer{} })
+
+	// 频繁发送时与邮箱不存在的响应相同 但只发送一次
+	for _, email := range []string{u.Email, u.Email, "nobody@example.com"} {
+		if r := env.JSON(t, http.MethodPost, "/verify-email/resend", `{"email":"`+email+`"}`, ""); r.Code != pkg.SuccessCode {
+			t.Fatalf("不应暴露邮箱是否注册 email:%v code:%v", email, r.Code)
+		}
+	}
+	if n := m.count(); n != 1 {
+		t.Fatalf("resend_interval 内应只发送一次 got:%v", n)
+	}
+}
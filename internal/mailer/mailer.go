@@ -0,0 +1,157 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 待发送的邮件
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// 邮件发送接口 不同环境使用不同实现
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// 全局邮件发送器 由 internal.InitMailer 初始化
+var Default Mailer = LogMailer{}
+
+func Send(ctx context.Context, msg Message) error {
+	return Default.Send(ctx, msg)
+}
+
+// 只把邮件内容写到日志 用于本地开发
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	zap.S().Infof("[mail] to:%v subject:%v body:%v", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// 把邮件写成 .eml 文件放到 outbox 目录 离线环境下可以直接打开查看
+type FileMailer struct {
+	From string
+	Dir  string
+}
+
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	// 文件名 时间戳_收件人.eml
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102T150405.000000000"), sanitize(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), buildMessage(m.From, msg), 0644)
+}
+
+// SMTP 连接和收发的超时时间 ctx 的截止时间更早时以 ctx 为准
+const smtpTimeout = 30 * time.Second
+
+// 通过SMTP发送 服务器支持时使用 STARTTLS 流程同 smtp.SendMail
+type SMTPMailer struct {
+	From     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// 请求取消时关闭连接 中断正在进行的读写
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := m.send(conn, msg); err != nil {
+		// 因取消而关闭连接时返回取消的原因
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (m SMTPMailer) send(conn net.Conn, msg Message) error {
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: 服务器不支持 AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMessage(m.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// 生成 RFC 5322 格式的邮件内容 主题按 RFC 2047 编码
+func buildMessage(from string, msg Message) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, msg.To, mime.QEncoding.Encode("UTF-8", msg.Subject), time.Now().Format(time.RFC1123Z), msg.Body))
+}
+
+// 收件人地址中的特殊字符不能出现在文件名里
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < 32 {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API key 的基础权限 可访问本人的用户信息接口
+const ScopeProfile = "profile"
+
+// 创建 API key 时可选的scope 除 profile 外均为权限名 且不能超出创建者自身的权限
+func ValidScope(scope string) bool {
+	return scope == ScopeProfile || slices.Contains(AllPermissions, scope)
+}
+
+// 服务间调用使用的 API key 明文只在创建时返回一次 数据库中只保存摘要
+type APIKey struct {
+	gorm.Model
+	UserID     uint   `gorm:"index"`
+	Name       string `gorm:"size:64"`
+	Prefix     string `gorm:"size:16"`                      // 明文的前缀 用于在列表中辨认
+	KeyHash    string `gorm:"size:64;uniqueIndex" json:"-"` // 完整明文的sha256
+	Scopes     string `gorm:"size:255"`                     // 逗号分隔
+	MFA        bool   `gorm:"not null;default:false"`       // 创建时是否通过了两步验证登录 使用key时视为同样通过
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	User       User `json:"-"`
+}
+
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
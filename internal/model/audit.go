@@ -0,0 +1,52 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 安全事件类型
+const (
+	EventLoginSuccess   = "login_success"
+	EventLoginFailure   = "login_failure"
+	EventPasswordChange = "password_change"
+	EventUsernameChange = "username_change"
+	EventAccountDelete  = "account_delete"
+	EventMFAEnable      = "mfa_enable"
+	EventMFADisable     = "mfa_disable"
+	EventAPIKeyCreate   = "api_key_create"
+	EventAPIKeyRevoke   = "api_key_revoke"
+	EventIdentityLink   = "identity_link"
+	EventIdentityUnlink = "identity_unlink"
+	EventOAuthConsent   = "oauth_consent"
+	EventOAuthRevoke    = "oauth_consent_revoke"
+)
+
+var ErrAuditAppendOnly = errors.New("security event is append-only")
+
+// 安全审计记录 只允许追加 不允许修改和删除
+// 只是通过下面的 GORM 钩子拦截 UpdateColumn、SkipHooks 会话、Exec/Raw 原生SQL 都不经过钩子
+// 需要真正防篡改时 给应用使用的数据库账号只授予该表的 INSERT/SELECT 权限
+// 用户不存在的登录失败 UserID 为0 Username 为尝试登录的用户名
+type SecurityEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	UserID    uint      `gorm:"index"`
+	Username  string    `gorm:"size:64;index"`
+	Type      string    `gorm:"size:32;index"`
+	IP        string    `gorm:"size:64"`
+	UserAgent string    `gorm:"size:255"`
+	Detail    string    `gorm:"size:255"` // 失败原因、变更内容等
+}
+
+// 拦截通过模型发起的 Update/Updates/Save
+func (e *SecurityEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+// 拦截通过模型发起的 Delete 包括按条件批量删除
+func (e *SecurityEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditAppendOnly
+}
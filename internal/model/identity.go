@@ -0,0 +1,12 @@
+package model
+
+import "gorm.io/gorm"
+
+// 用户绑定的第三方登录身份 同一提供方的同一subject只能绑定一个用户
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	Provider string `gorm:"size:32;uniqueIndex:idx_provider_subject"`
+	Subject  string `gorm:"size:255;uniqueIndex:idx_provider_subject"`
+	Email    string `gorm:"size:255"` // 绑定时提供方返回的邮箱
+}
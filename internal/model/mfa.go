@@ -0,0 +1,26 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 用户的 TOTP 两步验证
+// 发起绑定时创建 ConfirmedAt 为空 使用第一个验证码确认后才算开启
+type UserTOTP struct {
+	gorm.Model
+	UserID      uint   `gorm:"uniqueIndex"`
+	Secret      string `gorm:"size:64" json:"-"`
+	ConfirmedAt *time.Time
+	// 最后一次成功使用的时间步 同一时间步的验证码不能重复使用
+	LastCounter int64
+}
+
+// 一次性恢复码 只保存摘要 丢失验证器时代替验证码使用
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"size:64;index" json:"-"`
+	UsedAt   *time.Time
+}
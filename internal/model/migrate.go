@@ -0,0 +1,8 @@
+package model
+
+import "gorm.io/gorm"
+
+// 创建和更新全部数据表
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&User{}, &Role{}, &Permission{}, &UserTOTP{}, &RecoveryCode{}, &SecurityEvent{}, &APIKey{}, &UserIdentity{}, &OAuthClient{}, &OAuthConsent{})
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// 支持的授权方式
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OIDC 标准scope 其余scope由接入的应用自行定义和解释
+const (
+	ScopeOpenID = "openid" // 签发 id_token 并允许访问 userinfo
+	ScopeEmail  = "email"  // id_token 和 userinfo 中包含邮箱
+)
+
+// 接入本服务的OAuth应用 没有密钥的是公开客户端(SPA、移动端) 只能使用授权码 + PKCE
+type OAuthClient struct {
+	gorm.Model
+	ClientID     string `gorm:"size:64;uniqueIndex"`
+	SecretHash   string `gorm:"size:64" json:"-"` // 密钥的sha256 公开客户端为空
+	Name         string `gorm:"size:64"`
+	RedirectURIs string `gorm:"size:1024"` // 空格分隔 回调地址必须完全匹配
+	Scopes       string `gorm:"size:512"`  // 空格分隔 允许申请的scope
+	GrantTypes   string `gorm:"size:64"`   // 空格分隔
+}
+
+func (o *OAuthClient) Public() bool {
+	return o.SecretHash == ""
+}
+
+func (o *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(o.RedirectURIs)
+}
+
+func (o *OAuthClient) ScopeList() []string {
+	return strings.Fields(o.Scopes)
+}
+
+func (o *OAuthClient) AllowGrant(grant string) bool {
+	return slices.Contains(strings.Fields(o.GrantTypes), grant)
+}
+
+// 用户同意授予应用的scope 再次授权时scope已覆盖的可以跳过确认
+type OAuthConsent struct {
+	gorm.Model
+	UserID   uint   `gorm:"uniqueIndex:idx_user_client"`
+	ClientID string `gorm:"size:64;uniqueIndex:idx_user_client"`
+	Scopes   string `gorm:"size:512"` // 空格分隔
+}
+
+func (o *OAuthConsent) Covers(scopes []string) bool {
+	granted := strings.Fields(o.Scopes)
+	for _, s := range scopes {
+		if !slices.Contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
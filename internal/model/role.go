@@ -0,0 +1,50 @@
+package model
+
+import "gorm.io/gorm"
+
+// 权限标识 资源:操作
+const (
+	PermUsersRead  = "users:read"  // 查看用户
+	PermUsersWrite = "users:write" // 管理用户
+	PermRolesRead  = "roles:read"  // 查看角色
+	PermRolesWrite = "roles:write" // 分配角色
+	PermAuditRead  = "audit:read"  // 查看安全审计记录
+
+	PermOAuthClientsRead  = "oauth_clients:read"  // 查看接入的OAuth应用
+	PermOAuthClientsWrite = "oauth_clients:write" // 注册和删除OAuth应用
+	PermCacheRead         = "cache:read"          // 查看缓存命中统计
+)
+
+// 内置管理员角色 拥有全部权限
+const RoleAdmin = "admin"
+
+// 所有内置权限 启动时写入数据库
+var AllPermissions = []string{PermUsersRead, PermUsersWrite, PermRolesRead, PermRolesWrite, PermAuditRead, PermOAuthClientsRead, PermOAuthClientsWrite, PermCacheRead}
+
+type Role struct {
+	gorm.Model
+	Name        string       `gorm:"uniqueIndex;size:64"`
+	Permissions []Permission `gorm:"many2many:role_permission"`
+}
+
+type Permission struct {
+	gorm.Model
+	Name string `gorm:"uniqueIndex;size:64"`
+}
+
+// 用户拥有的角色名和权限名(去重)
+// 需要先 Preload("Roles.Permissions")
+func (u *User) RoleNames() (roles []string, perms []string) {
+	seen := map[string]struct{}{}
+	for _, r := range u.Roles {
+		roles = append(roles, r.Name)
+		for _, p := range r.Permissions {
+			if _, ok := seen[p.Name]; ok {
+				continue
+			}
+			seen[p.Name] = struct{}{}
+			perms = append(perms, p.Name)
+		}
+	}
+	return roles, perms
+}
@@ -1,6 +1,17 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 用户状态
+const (
+	UserStatusPending  = "pending"  // 已注册 邮箱未验证
+	UserStatusActive   = "active"   // 正常
+	UserStatusDisabled = "disabled" // 已被管理员禁用
+)
 
 // 预定义数据库模型
 type User struct {
@@ -8,4 +19,8 @@ type User struct {
 	Username string
 	Password string
 	Email    string
+	Status   string `gorm:"size:16;default:active;index"`
+	Roles    []Role `gorm:"many2many:user_role" json:",omitempty"`
+	// 邮箱验证时间 为空表示未验证
+	EmailVerifiedAt *time.Time
 }
@@ -0,0 +1,234 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"ginwebproject1/pkg"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// 内置的测试用 OIDC 提供方 不需要外网即可走完整个登录流程
+// 授权页不需要输入密码 直接按 login_hint 指定的邮箱签发身份
+// email_verified=false 可以模拟未验证邮箱的账号
+// 只用于开发和测试 签名密钥在启动时随机生成 重启后失效
+type Fake struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	key          *rsa.PrivateKey
+	kid          string
+
+	mu    sync.Mutex
+	codes map[string]*fakeCode
+}
+
+type fakeCode struct {
+	nonce         string
+	challenge     string
+	email         string
+	emailVerified bool
+	expiresAt     time.Time
+}
+
+// 授权码有效期
+const fakeCodeExpire = time.Minute
+
+func NewFake(conf ProviderConfig) (*Fake, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := pkg.RandomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	return &Fake{
+		issuer:       conf.Issuer,
+		clientID:     conf.ClientID,
+		clientSecret: conf.ClientSecret,
+		redirectURL:  conf.RedirectURL,
+		key:          key,
+		kid:          kid,
+		codes:        map[string]*fakeCode{},
+	}, nil
+}
+
+// 请求路径需要去掉 issuer 的路径前缀
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		f.discovery(w)
+	case "/authorize":
+		f.authorize(w, r)
+	case "/token":
+		f.token(w, r)
+	case "/jwks":
+		f.jwks(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fakeError(w http.ResponseWriter, status int, code, desc string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": desc})
+}
+
+func (f *Fake) discovery(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                f.issuer,
+		"authorization_endpoint":                f.issuer + "/authorize",
+		"token_endpoint":                        f.issuer + "/token",
+		"jwks_uri":                              f.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (f *Fake) jwks(w http.ResponseWriter) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	pub := f.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]any{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": f.kid,
+		"n":   b64(pub.N.Bytes()),
+		"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+// 直接同意授权 重定向回客户端
+func (f *Fake) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != f.clientID || q.Get("redirect_uri") != f.redirectURL {
+		// 客户端或回调地址错误时不能重定向
+		fakeError(w, http.StatusBadRequest, "invalid_request", "unknown client_id or redirect_uri")
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		fakeError(w, http.StatusBadRequest, "invalid_request", "authorization code with S256 PKCE required")
+		return
+	}
+	email := q.Get("login_hint")
+	if email == "" {
+		email = "fake.user@example.com"
+	}
+	code, err := pkg.RandomToken(16)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	f.mu.Lock()
+	now := time.Now()
+	for k, c := range f.codes {
+		if now.After(c.expiresAt) {
+			delete(f.codes, k)
+		}
+	}
+	f.codes[code] = &fakeCode{
+		nonce:         q.Get("nonce"),
+		challenge:     q.Get("code_challenge"),
+		email:         email,
+		emailVerified: q.Get("email_verified") != "false",
+		expiresAt:     now.Add(fakeCodeExpire),
+	}
+	f.mu.Unlock()
+	v := url.Values{}
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	http.Redirect(w, r, f.redirectURL+"?"+v.Encode(), http.StatusFound)
+}
+
+func (f *Fake) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeError(w, http.StatusMethodNotAllowed, "invalid_request", "POST required")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != f.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(f.clientSecret)) != 1 {
+		fakeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != f.redirectURL {
+		fakeError(w, http.StatusBadRequest, "invalid_grant", "bad grant_type or redirect_uri")
+		return
+	}
+	// 授权码只能使用一次
+	f.mu.Lock()
+	c, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	f.mu.Unlock()
+	if !ok || time.Now().After(c.expiresAt) {
+		fakeError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+	if CodeChallenge(r.PostForm.Get("code_verifier")) != c.challenge {
+		fakeError(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(c.email)))
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                f.issuer,
+		"sub":                "fake-" + hex.EncodeToString(sum[:8]),
+		"aud":                f.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              c.nonce,
+		"email":              c.email,
+		"email_verified":     c.emailVerified,
+		"name":               c.email,
+		"preferred_username": strings.Split(c.email, "@")[0],
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = f.kid
+	idToken, err := token.SignedString(f.key)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, err := pkg.RandomToken(32)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
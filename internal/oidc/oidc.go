@@ -0,0 +1,67 @@
+package oidc
+
+import (
+	"fmt"
+	"ginwebproject1/internal/config"
+	"net/url"
+)
+
+// 内置测试提供方使用的名称 对应 oidc.providers 中的同名配置
+const FakeName = "fake"
+
+var (
+	providers = map[string]*Provider{}
+	fake      *Fake
+)
+
+// 按配置创建所有提供方 元数据在第一次登录时获取 提供方暂时不可用不影响启动
+// 开启 oidc.fake 时同时创建内置的测试提供方
+func Init() error {
+	c := config.Config.OIDCConf
+	providers, fake = map[string]*Provider{}, nil
+	for name, pc := range c.Providers {
+		// 未开启 oidc.fake 时忽略同名配置 不能作为普通提供方使用
+		if name == FakeName && !c.Fake {
+			continue
+		}
+		conf := ProviderConfig{
+			Issuer:       pc.Issuer,
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			RedirectURL:  pc.RedirectURL,
+			Scopes:       pc.Scopes,
+		}
+		if conf.Issuer == "" || conf.ClientID == "" || conf.RedirectURL == "" {
+			return fmt.Errorf("OIDC提供方配置不完整 name:%v", name)
+		}
+		providers[name] = NewProvider(name, conf)
+		if name == FakeName {
+			f, err := NewFake(conf)
+			if err != nil {
+				return err
+			}
+			fake = f
+		}
+	}
+	if c.Fake && fake == nil {
+		return fmt.Errorf("开启了 oidc.fake 但缺少名为 %v 的提供方配置", FakeName)
+	}
+	return nil
+}
+
+func Get(name string) (*Provider, bool) {
+	p, ok := providers[name]
+	return p, ok
+}
+
+// 内置测试提供方 及其挂载的路径(issuer 的路径部分) 未开启时返回 nil
+func FakeProvider() (*Fake, string) {
+	if fake == nil {
+		return nil, ""
+	}
+	u, err := url.Parse(fake.issuer)
+	if err != nil {
+		return nil, ""
+	}
+	return fake, u.Path
+}
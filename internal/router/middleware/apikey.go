@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"errors"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/pkg"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 携带 API key 的请求头
+const APIKeyHeader = "X-API-Key"
+
+// 通过 API key 认证的请求 写入 amr
+const AMRAPIKey = "apikey"
+
+// 最近使用时间的精度 避免每个请求都写数据库
+const apiKeyTouchInterval = time.Minute
+
+// 同时接受 JWT 和 API key 两种认证方式 写入相同的 Claims
+// 账号安全相关的接口(改密码、两步验证、会话、API key管理)应只使用 VerifyJWT
+func Authenticate() gin.HandlerFunc {
+	verifyJWT := VerifyJWT()
+	return func(c *gin.Context) {
+		if key := c.GetHeader(APIKeyHeader); key != "" {
+			verifyAPIKey(c, key)
+			return
+		}
+		verifyJWT(c)
+	}
+}
+
+func verifyAPIKey(c *gin.Context, key string) {
+	k := model.APIKey{}
+	tx := config.DB.Preload("User.Roles.Permissions").Where("key_hash = ?", pkg.HashToken(key)).First(&k)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserAPIKeyErrCode))
+		c.Abort()
+		return
+	}
+	if tx.Error != nil {
+		zap.S().Errorf("verifyAPIKey query key err:%v", tx.Error)
+		c.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+		c.Abort()
+		return
+	}
+	now := time.Now()
+	// 已吊销、已过期或所属用户已删除、已禁用
+	if k.RevokedAt != nil || now.After(k.ExpiresAt) || k.User.ID == 0 || k.User.Status == model.UserStatusDisabled {
+		c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserAPIKeyErrCode))
+		c.Abort()
+		return
+	}
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchInterval {
+		if err := config.DB.Model(&k).UpdateColumn("last_used_at", now).Error; err != nil {
+			zap.S().Errorf("verifyAPIKey update last_used_at keyId:%v err:%v", k.ID, err)
+		}
+	}
+	// 实际权限为scope与用户当前权限的交集 角色被收回后key随之失效
+	_, userPerms := k.User.RoleNames()
+	var perms []string
+	for _, scope := range k.ScopeList() {
+		if scope == model.ScopeProfile || slices.Contains(userPerms, scope) {
+			perms = append(perms, scope)
+		}
+	}
+	amr := []string{AMRAPIKey}
+	// 继承创建key时的两步验证状态
+	if k.MFA {
+		amr = append(amr, AMRMFA)
+	}
+	c.Set(claimsKey, &Claims{
+		UserID:   k.User.ID,
+		Username: k.User.Username,
+		Perms:    perms,
+		AMR:      amr,
+		APIKeyID: k.ID,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.FormatUint(uint64(k.User.ID), 10),
+			ExpiresAt: k.ExpiresAt.Unix(),
+		},
+	})
+	c.Next()
+}
+
+// 要求 API key 拥有指定scope 通过 JWT 登录的用户不受限制
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentUser, ok := CurrentUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+			c.Abort()
+			return
+		}
+		if currentUser.APIKeyID != 0 && !slices.Contains(currentUser.Perms, scope) {
+			c.JSON(http.StatusForbidden, pkg.Fail(pkg.UserPermissionErrCode))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"errors"
+	"ginwebproject1/internal/config"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// gin.Context 中保存当前用户claims的key
+const claimsKey = "claims"
+
+// 认证方式 写入 amr 声明 RFC 8176
+const (
+	AMRPassword = "pwd" // 密码
+	AMRMFA      = "mfa" // 通过了两步验证
+)
+
+// 本服务签发的 JWT 负载
+// StandardClaims 提供 jti(Id) iss aud iat nbf exp sub
+type Claims struct {
+	UserID    uint     `json:"uid"`              // 用户ID
+	Username  string   `json:"username"`         // 用户名
+	Roles     []string `json:"roles,omitempty"`  // 角色
+	Perms     []string `json:"perms,omitempty"`  // 权限 登录或刷新时从数据库读取
+	AMR       []string `json:"amr,omitempty"`    // 认证方式
+	SessionID string   `json:"sid,omitempty"`    // 所属会话 即refresh token家族id
+	APIKeyID  uint     `json:"-"`                // 通过 API key 认证时的key id 不写入token
+	IssuedMs  int64    `json:"iat_ms,omitempty"` // 签发时间 毫秒 iat 只精确到秒 无法与同一秒内的吊销区分先后
+	jwt.StandardClaims
+}
+
+// 毫秒签发时间 旧版本签发的token没有 iat_ms 使用 iat
+func (c *Claims) IssuedAtMillis() int64 {
+	if c.IssuedMs > 0 {
+		return c.IssuedMs
+	}
+	return c.IssuedAt * 1000
+}
+
+// 签名校验通过后由 jwt 库调用 校验时间、签发方和受众
+// 允许 clock_skew 范围内的时钟误差
+func (c *Claims) Valid() error {
+	conf := config.Config.JWTConf
+	skew := int64(conf.ClockSkew / time.Second)
+	now := time.Now().Unix()
+	if !c.VerifyExpiresAt(now-skew, true) {
+		return errors.New("token已过期")
+	}
+	if !c.VerifyIssuedAt(now+skew, false) {
+		return errors.New("token签发时间晚于当前时间")
+	}
+	if !c.VerifyNotBefore(now+skew, false) {
+		return errors.New("token尚未生效")
+	}
+	if !c.VerifyIssuer(conf.Issuer, true) {
+		return errors.New("token签发方错误")
+	}
+	if !c.VerifyAudience(conf.Audience, true) {
+		return errors.New("token受众错误")
+	}
+	if c.Id == "" {
+		return errors.New("token缺少jti")
+	}
+	if c.UserID == 0 || c.Subject != strconv.FormatUint(uint64(c.UserID), 10) {
+		return errors.New("token用户信息错误")
+	}
+	return nil
+}
+
+// 本次登录是否通过了两步验证
+func (c *Claims) MFA() bool {
+	return slices.Contains(c.AMR, AMRMFA)
+}
+
+// 获取当前登录用户 由 VerifyJWT 写入 handler 中不需要再做类型断言
+func CurrentUser(c *gin.Context) (*Claims, bool) {
+	v, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 按优先级从请求中取出 access token
+// 1. Authorization: Bearer <jwt>  2. 旧的 token 请求头  3. cookie(开启cookie模式时)
+// fromCookie 为 true 时调用方需要做 CSRF 校验
+func tokenFromRequest(c *gin.Context) (token string, fromCookie bool) {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return strings.TrimSpace(auth[7:]), false
+		}
+	}
+	if token := c.GetHeader("token"); token != "" {
+		return token, false
+	}
+	conf := config.Config.JWTConf.Cookie
+	if conf.Enable {
+		if token, err := c.Cookie(conf.Name); err == nil && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// 双重提交 CSRF 校验 请求头中的值必须与 csrf cookie 一致
+// 安全方法(GET/HEAD/OPTIONS)不校验
+func CheckCSRF(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	conf := config.Config.JWTConf.Cookie
+	cookie, err := c.Cookie(conf.CSRFCookie)
+	if err != nil || cookie == "" {
+		return false
+	}
+	header := c.GetHeader(conf.CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+func sameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func setCookie(c *gin.Context, name, value, path string, ttl time.Duration, httpOnly bool) {
+	conf := config.Config.JWTConf.Cookie
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   conf.Domain,
+		MaxAge:   int(ttl / time.Second),
+		Secure:   conf.Secure,
+		HttpOnly: httpOnly,
+		SameSite: sameSite(conf.SameSite),
+	})
+}
+
+// cookie模式下写入 access/refresh token 和 CSRF token
+// token 为 HttpOnly 前端脚本无法读取 CSRF token 需要前端读取后放到请求头
+func SetAuthCookies(c *gin.Context, accessToken, refreshToken string) error {
+	conf := config.Config.JWTConf
+	if !conf.Cookie.Enable {
+		return nil
+	}
+	csrf, err := pkg.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	setCookie(c, conf.Cookie.Name, accessToken, "/", conf.AccessExpire, true)
+	setCookie(c, conf.Cookie.RefreshName, refreshToken, "/", conf.RefreshExpire, true)
+	setCookie(c, conf.Cookie.CSRFCookie, csrf, "/", conf.RefreshExpire, false)
+	return nil
+}
+
+// 登出时清除所有认证相关cookie
+func ClearAuthCookies(c *gin.Context) {
+	conf := config.Config.JWTConf.Cookie
+	if !conf.Enable {
+		return
+	}
+	setCookie(c, conf.Name, "", "/", -1, true)
+	setCookie(c, conf.RefreshName, "", "/", -1, true)
+	setCookie(c, conf.CSRFCookie, "", "/", -1, false)
+}
+
+// 读取cookie中的refresh token
+func RefreshTokenFromCookie(c *gin.Context) string {
+	conf := config.Config.JWTConf.Cookie
+	if !conf.Enable {
+		return ""
+	}
+	token, _ := c.Cookie(conf.RefreshName)
+	return token
+}
@@ -1,11 +1,16 @@
 package middleware
 
 import (
+	"crypto"
 	"fmt"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
 	"ginwebproject1/pkg"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
@@ -14,86 +19,216 @@ import (
 
 const Secret = "zhouzhan"
 
+// 单个签名密钥 由kid标识 启动时解析一次 之后只读
+type jwtKey struct {
+	kid        string
+	method     jwt.SigningMethod // 该key绑定的签名算法 RS256/ES256/EdDSA
+	privateKey crypto.PrivateKey // 私钥 仅签名用的活动key需要
+	publicKey  crypto.PublicKey  // 公钥 用于验证
+	retireAt   time.Time         // 退役时间 之后不再接受该key签发的token 零值表示不退役
+}
+
+// 密钥环 activeKid 对应的key用于签名 其余key只用于验证直到退役
 type JWTINFO struct {
-	privateKey []byte
-	publicKey  []byte
+	activeKid string
+	keys      map[string]*jwtKey
 }
 
-func NewJWT() *JWTINFO {
-	// 加载 JWT 公钥和私钥 的函数，目的是为了让你的服务能创建和验证 基于 RSA 非对称加密的 JWT Token
-	var err error
-	var publicKey []byte
-	var privateKey []byte
+// 全局共享的密钥环 热更新时整体替换
+var current atomic.Pointer[JWTINFO]
 
-	privateKey, err = os.ReadFile("./internal/router/middleware/private.key")
-	if err != nil {
-		log.Fatalf("私钥加载失败 %v", err)
+func NewJWT() (*JWTINFO, error) {
+	// 加载 JWT 公钥和私钥 的函数，目的是为了让你的服务能创建和验证 基于非对称加密的 JWT Token
+	// 密钥路径、算法和轮换策略来自 config.yaml 的 jwt 配置
+	c := config.Config.JWTConf
+	j := &JWTINFO{
+		activeKid: c.ActiveKid,
+		keys:      map[string]*jwtKey{},
 	}
-	publicKey, err = os.ReadFile("./internal/router/middleware/public.key")
+	for _, kc := range c.Keys {
+		// 未配置算法时沿用 RS256
+		alg := kc.Alg
+		if alg == "" {
+			alg = jwt.SigningMethodRS256.Alg()
+		}
+		method, ok := signingMethods[alg]
+		if !ok {
+			return nil, fmt.Errorf("不支持的签名算法 kid:%v alg:%v", kc.Kid, alg)
+		}
+		k := &jwtKey{kid: kc.Kid, method: method}
+		if kc.PrivateKey != "" {
+			pem, err := os.ReadFile(kc.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("私钥加载失败 kid:%v %v", kc.Kid, err)
+			}
+			k.privateKey, err = parsePrivateKey(method, pem)
+			if err != nil {
+				return nil, fmt.Errorf("解析私钥失败 kid:%v alg:%v %v", kc.Kid, alg, err)
+			}
+		}
+		pem, err := os.ReadFile(kc.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("公钥加载失败 kid:%v %v", kc.Kid, err)
+		}
+		k.publicKey, err = parsePublicKey(method, pem)
+		if err != nil {
+			return nil, fmt.Errorf("解析公钥失败 kid:%v alg:%v %v", kc.Kid, alg, err)
+		}
+		if kc.RetireAt != "" {
+			k.retireAt, err = time.Parse(time.RFC3339, kc.RetireAt)
+			if err != nil {
+				return nil, fmt.Errorf("退役时间格式错误 kid:%v %v", kc.Kid, err)
+			}
+		}
+		j.keys[kc.Kid] = k
+	}
+	active, ok := j.keys[j.activeKid]
+	if !ok || active.privateKey == nil {
+		return nil, fmt.Errorf("活动签名密钥不存在或缺少私钥 kid:%v", j.activeKid)
+	}
+	return j, nil
+}
+
+// 启动时加载密钥环 失败直接返回错误 由调用方终止启动
+func InitJWT() error {
+	j, err := NewJWT()
 	if err != nil {
-		log.Fatalf("公钥加载失败 %v", err)
+		return err
 	}
-	return &JWTINFO{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+	current.Store(j)
+	return nil
+}
+
+// 获取当前共享的密钥环
+func GetJWT() *JWTINFO {
+	return current.Load()
+}
+
+// 查找可用于验证的key 未携带kid的旧token使用活动key
+func (j *JWTINFO) verifyKey(kid string) (*jwtKey, error) {
+	if kid == "" {
+		kid = j.activeKid
 	}
+	k, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("未知的kid:%v", kid)
+	}
+	if !k.retireAt.IsZero() && time.Now().After(k.retireAt) {
+		return nil, fmt.Errorf("密钥已退役 kid:%v", kid)
+	}
+	return k, nil
 }
 
 // 生成签名后的jwt
-func (j *JWTINFO) GenerateJWT(claims jwt.MapClaims) (string, error) {
-	// 用 RSA 私钥生成 JWT JSON Web Token
-	// 接收一组 claims（声明/负载），类型是 jwt.MapClaims（底层是 map[string]interface{}）
+func (j *JWTINFO) GenerateJWT(claims *Claims) (string, error) {
+	// 用活动key的私钥生成 JWT JSON Web Token
+	// 接收一组 claims（声明/负载） 未填写的 jti iat nbf iss aud sub 使用默认值
 	// 返回签名后的 JWT 字符串 和可能的 error
 
-	// 先解析私钥
-	rsaPrivateKey, err := jwt.ParseRSAPrivateKeyFromPEM(j.privateKey)
-	if err != nil {
-		return "", fmt.Errorf("解析RSA加密私钥失败:%v", err)
+	// 每个token带唯一的jti 用于注销时加入黑名单
+	if claims.Id == "" {
+		jti, err := pkg.RandomToken(16)
+		if err != nil {
+			return "", fmt.Errorf("生成jti失败:%v", err)
+		}
+		claims.Id = jti
+	}
+	issued := time.Now()
+	now := issued.Unix()
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = now
+		claims.IssuedMs = issued.UnixMilli()
+	}
+	if claims.NotBefore == 0 {
+		claims.NotBefore = now
+	}
+	if claims.Issuer == "" {
+		claims.Issuer = config.Config.JWTConf.Issuer
 	}
-	// 构建带声明的 JWT Token
+	if claims.Audience == "" {
+		claims.Audience = config.Config.JWTConf.Audience
+	}
+	if claims.Subject == "" {
+		claims.Subject = strconv.FormatUint(uint64(claims.UserID), 10)
+	}
+
+	return j.Sign(claims, "")
+}
+
+// 用活动key签名任意声明 typ 非空时写入header 用于区分令牌类型
+func (j *JWTINFO) Sign(claims jwt.Claims, typ string) (string, error) {
+	// 私钥在启动时已解析
+	active := j.keys[j.activeKid]
+	// 构建带声明的 JWT Token 算法由活动key决定
 	// claims  要放到JWT 负载里的数据
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(active.method, claims)
+	// 在header中写入kid 验证方据此选择公钥
+	token.Header["kid"] = j.activeKid
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
 
-	// 用刚才解析得到的 rsaPrivateKey 对 token 进行签名
+	// 用活动key的私钥对 token 进行签名
 	// 返回的是一个完整的 JWT 字符串（格式：header.payload.signature），可以在网络中传输
-	tokenString, err := token.SignedString(rsaPrivateKey)
+	tokenString, err := token.SignedString(active.privateKey)
 	if err != nil {
 		return "", fmt.Errorf("签名失败 err %v", err)
 	}
 	return tokenString, nil
 }
 
+// 当前签名使用的算法 写入发现文档
+func (j *JWTINFO) SigningAlg() string {
+	return j.keys[j.activeKid].method.Alg()
+}
+
 // 解析签名后的jwt xxxxx.yyyyy.zzzzz  Header（含 alg）Payload（含 claims）Signature（签名）
-func (j *JWTINFO) PraseToken(tokenString string) (jwt.MapClaims, error) {
-	// 解析公钥
-	rsaPublicKey, err := jwt.ParseRSAPublicKeyFromPEM(j.publicKey)
+func (j *JWTINFO) PraseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := j.parse(tokenString, claims)
 	if err != nil {
-		return nil, fmt.Errorf("解析rsa公钥失败 err:%v", err)
+		return nil, err
+	}
+	// 签发给其他应用的访问令牌不能用于登录本服务
+	if typ, _ := token.Header["typ"].(string); typ == OAuthAccessTokenType {
+		return nil, fmt.Errorf("token类型错误 typ:%v", typ)
 	}
+	return claims, nil
+}
+
+// 校验签名并解析到 claims 时间、签发方、受众由 claims.Valid 校验
+func (j *JWTINFO) parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
 	// 解析并验证 token
 	// func 回调函数
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		// 验证签名方法
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-			// 手动验证签名方式 防止伪造一个 token，把 alg 改成 none
+	// ValidMethods 限定算法白名单 none、HS256 等一律拒绝
+	parser := &jwt.Parser{ValidMethods: validMethods()}
+	token, err := parser.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		// 根据header中的kid选择公钥
+		kid, _ := t.Header["kid"].(string)
+		k, err := j.verifyKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// 验证签名方法 必须与kid绑定的算法一致
+		// 手动验证签名方式 防止伪造一个 token，把 alg 改成 none 或其他算法
+		if t.Method.Alg() != k.method.Alg() {
 			return nil, fmt.Errorf("签名方法错误 err:%v", t.Header["alg"])
 		}
-		return rsaPublicKey, nil
+		return k.publicKey, nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("JWT 验证失败 err:%v", err)
 	}
 	// 检查token有效性
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	} else {
+	if !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+	return token, nil
 }
 
 func VerifyJWT() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		tokenString := ctx.GetHeader("token")
+		tokenString, fromCookie := tokenFromRequest(ctx)
 		if tokenString == "" {
 			ctx.JSON(http.StatusUnauthorized, map[string]string{
 				"msg": "请先登录",
@@ -102,15 +237,54 @@ func VerifyJWT() gin.HandlerFunc {
 			// 阻止后续 handler 但不会阻止当前函数执行
 			return
 		}
-		j := NewJWT()
-		claims, err := j.PraseToken(tokenString)
+		// 浏览器会自动携带cookie 需要校验CSRF token
+		if fromCookie && !CheckCSRF(ctx) {
+			ctx.JSON(http.StatusForbidden, pkg.Fail(pkg.UserCSRFErrCode))
+			ctx.Abort()
+			return
+		}
+		claims, err := GetJWT().PraseToken(tokenString)
 		if err != nil {
 			zap.S().Errorf("JWT解析错误 err:%v", err)
 			ctx.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
 			ctx.Abort()
 			return
 		}
-		ctx.Set("claims", claims)
+		// 检查token是否已注销、被吊销或所属会话已结束
+		revoked, err := cache.IsAccessTokenRevoked(ctx.Request.Context(), claims.Id, claims.UserID, claims.IssuedAtMillis(), claims.SessionID)
+		if err != nil {
+			zap.S().Errorf("VerifyJWT.cache.IsAccessTokenRevoked jti:%v err:%v", claims.Id, err)
+			ctx.JSON(http.StatusOK, pkg.Fail(pkg.InternalErrCode))
+			ctx.Abort()
+			return
+		}
+		if revoked {
+			ctx.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+			ctx.Abort()
+			return
+		}
+		if claims.SessionID != "" {
+			touchSession(ctx, claims.SessionID)
+		}
+		ctx.Set(claimsKey, claims)
 		ctx.Next()
 	}
 }
+
+// 生成 JWKS(JSON Web Key Set) 只包含未退役的公钥 供其他服务校验token
+func (j *JWTINFO) JWKS() (map[string]any, error) {
+	keys := []map[string]any{}
+	for kid := range j.keys {
+		k, err := j.verifyKey(kid)
+		if err != nil {
+			// 已退役的key不再公开
+			continue
+		}
+		jwk, err := publicJWK(kid, k.method, k.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]any{"keys": keys}, nil
+}
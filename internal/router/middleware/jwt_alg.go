@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// 允许的签名算法白名单
+// 解析token时 header中的alg 必须在白名单内 且与kid绑定的算法一致
+var signingMethods = map[string]jwt.SigningMethod{
+	jwt.SigningMethodRS256.Alg(): jwt.SigningMethodRS256,
+	jwt.SigningMethodES256.Alg(): jwt.SigningMethodES256,
+	jwt.SigningMethodEdDSA.Alg(): jwt.SigningMethodEdDSA,
+}
+
+func validMethods() []string {
+	algs := make([]string, 0, len(signingMethods))
+	for alg := range signingMethods {
+		algs = append(algs, alg)
+	}
+	return algs
+}
+
+// 根据算法选择对应的私钥解析方式
+func parsePrivateKey(method jwt.SigningMethod, pem []byte) (crypto.PrivateKey, error) {
+	switch method {
+	case jwt.SigningMethodRS256:
+		return jwt.ParseRSAPrivateKeyFromPEM(pem)
+	case jwt.SigningMethodES256:
+		key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 需要 P-256 曲线 实际为:%v", key.Curve.Params().Name)
+		}
+		return key, nil
+	case jwt.SigningMethodEdDSA:
+		return jwt.ParseEdPrivateKeyFromPEM(pem)
+	}
+	return nil, fmt.Errorf("不支持的签名算法:%v", method.Alg())
+}
+
+// 根据算法选择对应的公钥解析方式
+func parsePublicKey(method jwt.SigningMethod, pem []byte) (crypto.PublicKey, error) {
+	switch method {
+	case jwt.SigningMethodRS256:
+		return jwt.ParseRSAPublicKeyFromPEM(pem)
+	case jwt.SigningMethodES256:
+		key, err := jwt.ParseECPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 需要 P-256 曲线 实际为:%v", key.Curve.Params().Name)
+		}
+		return key, nil
+	case jwt.SigningMethodEdDSA:
+		return jwt.ParseEdPublicKeyFromPEM(pem)
+	}
+	return nil, fmt.Errorf("不支持的签名算法:%v", method.Alg())
+}
+
+// 将公钥转换为 JWK 格式 (RFC 7517 / RFC 8037)
+func publicJWK(kid string, method jwt.SigningMethod, publicKey crypto.PublicKey) (map[string]any, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwk := map[string]any{
+		"use": "sig",
+		"alg": method.Alg(),
+		"kid": kid,
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(key.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// 坐标需要按曲线长度补齐前导0
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = key.Curve.Params().Name
+		jwk["x"] = b64(key.X.FillBytes(make([]byte, size)))
+		jwk["y"] = b64(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = b64(key)
+	default:
+		return nil, fmt.Errorf("不支持的公钥类型:%T", publicKey)
+	}
+	return jwk, nil
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"ginwebproject1/internal/config"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// 监听密钥文件变化 重新加载后整体替换共享的密钥环
+// 新密钥解析失败时保留旧密钥环继续服务
+func WatchKeys() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// 监听所在目录而不是文件本身 很多工具通过 重命名/替换 的方式写入文件
+	dirs := map[string]struct{}{}
+	for _, kc := range config.Config.JWTConf.Keys {
+		for _, path := range []string{kc.PrivateKey, kc.PublicKey} {
+			if path != "" {
+				dirs[filepath.Dir(path)] = struct{}{}
+			}
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		// 一次替换往往触发多个事件 合并后只重载一次
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.S().Errorf("WatchKeys err:%v", err)
+			case <-reload:
+				reload = nil
+				j, err := NewJWT()
+				if err != nil {
+					zap.S().Errorf("WatchKeys 重新加载密钥失败 继续使用旧密钥 err:%v", err)
+					continue
+				}
+				current.Store(j)
+				zap.S().Infof("WatchKeys 密钥已重新加载 active_kid:%v", j.activeKid)
+			}
+		}
+	}()
+	return nil
+}
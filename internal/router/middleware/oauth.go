@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// 访问令牌的 typ RFC 9068 与本服务的登录令牌区分
+const OAuthAccessTokenType = "at+jwt"
+
+// 签发给接入应用的访问令牌
+// 授权码方式 sub 为用户id 客户端凭证方式 sub 为 client_id 且没有用户信息
+type OAuthClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"` // 空格分隔
+	UserID   uint   `json:"uid,omitempty"`
+	Username string `json:"username,omitempty"`
+	IssuedMs int64  `json:"iat_ms,omitempty"` // 签发时间 毫秒 与吊销时间比较
+	jwt.StandardClaims
+}
+
+func (c *OAuthClaims) IssuedAtMillis() int64 {
+	if c.IssuedMs > 0 {
+		return c.IssuedMs
+	}
+	return c.IssuedAt * 1000
+}
+
+func (c *OAuthClaims) Valid() error {
+	skew := int64(config.Config.JWTConf.ClockSkew / time.Second)
+	now := time.Now().Unix()
+	if !c.VerifyExpiresAt(now-skew, true) {
+		return errors.New("token已过期")
+	}
+	if !c.VerifyIssuedAt(now+skew, false) {
+		return errors.New("token签发时间晚于当前时间")
+	}
+	if !c.VerifyIssuer(config.Config.OAuthConf.Issuer, true) {
+		return errors.New("token签发方错误")
+	}
+	if !c.VerifyAudience(config.Config.OAuthConf.Audience, true) {
+		return errors.New("token受众错误")
+	}
+	if c.Id == "" || c.ClientID == "" || c.Subject == "" {
+		return errors.New("token缺少必要的声明")
+	}
+	return nil
+}
+
+func (c *OAuthClaims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// 签发给接入应用的 id_token 只供应用读取用户身份 本服务不再解析
+type IDTokenClaims struct {
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time,omitempty"`
+	AMR               []string `json:"amr,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     *bool    `json:"email_verified,omitempty"`
+	jwt.StandardClaims
+}
+
+// 生成访问令牌 补全 jti iat nbf iss aud
+func (j *JWTINFO) GenerateOAuthToken(claims *OAuthClaims) (string, error) {
+	jti, err := pkg.RandomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("生成jti失败:%v", err)
+	}
+	issued := time.Now()
+	now := issued.Unix()
+	claims.Id = jti
+	claims.IssuedAt = now
+	claims.IssuedMs = issued.UnixMilli()
+	claims.NotBefore = now
+	claims.Issuer = config.Config.OAuthConf.Issuer
+	claims.Audience = config.Config.OAuthConf.Audience
+	return j.Sign(claims, OAuthAccessTokenType)
+}
+
+// 解析访问令牌 用于令牌自省、吊销和 userinfo
+func (j *JWTINFO) ParseOAuthToken(tokenString string) (*OAuthClaims, error) {
+	claims := &OAuthClaims{}
+	token, err := j.parse(tokenString, claims)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := token.Header["typ"].(string); typ != OAuthAccessTokenType {
+		return nil, fmt.Errorf("token类型错误 typ:%v", typ)
+	}
+	return claims, nil
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 要求当前用户拥有指定权限 必须放在 VerifyJWT 之后
+// 权限来自token 角色变更后需要重新登录或刷新token才会生效
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentUser, ok := CurrentUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+			c.Abort()
+			return
+		}
+		if !slices.Contains(currentUser.Perms, perm) {
+			c.JSON(http.StatusForbidden, pkg.Fail(pkg.UserPermissionErrCode))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 按配置要求当前登录通过了两步验证 必须放在 VerifyJWT 之后
+// 未开启两步验证的管理员仍可登录 但需要先绑定验证器再重新登录才能访问
+func RequireMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.Config.MFAConf.RequireForAdmin {
+			c.Next()
+			return
+		}
+		currentUser, ok := CurrentUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, pkg.Fail(pkg.UserTokenErrCode))
+			c.Abort()
+			return
+		}
+		// API key 按创建时的登录状态判断 关闭该配置期间未经两步验证创建的key同样不能访问
+		if !currentUser.MFA() {
+			c.JSON(http.StatusForbidden, pkg.Fail(pkg.UserMFARequiredErrCode))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
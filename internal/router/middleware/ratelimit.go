@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/pkg"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// 限流算法
+const (
+	AlgSlidingWindow = "sliding_window"
+	AlgTokenBucket   = "token_bucket"
+)
+
+// 滑动窗口 使用有序集合记录窗口内每次请求的时间
+// KEYS[1] key  ARGV: 当前毫秒 窗口毫秒 上限 成员
+// 返回 {是否允许, 剩余次数, 窗口重置毫秒}
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local reset = window
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+// 令牌桶 按 rate 持续补充令牌 容量为 burst
+// KEYS[1] key  ARGV: 当前毫秒 每毫秒补充的令牌数 容量
+// 返回 {是否允许, 剩余令牌, 重置毫秒} 拒绝时为下一个令牌的等待时间 否则为补满所需时间
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1]) or capacity
+local ts = tonumber(data[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local reset = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+	reset = math.ceil((capacity - tokens) / rate)
+else
+	reset = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate))
+return {allowed, math.floor(tokens), reset}
+`)
+
+// 一次限流判断的结果
+type rateResult struct {
+	allowed   bool
+	limit     int64
+	remaining int64
+	reset     time.Duration // 额度恢复所需时间
+}
+
+// 按配置的规则限流 rule 对应 config.yaml 中 rate_limit.rules 的名称
+// 未配置该规则或限流关闭时不做任何处理
+// key 为 user 时需要放在 VerifyJWT 之后 未登录的请求按ip计数
+func RateLimit(rule string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conf := config.Config.RateLimitConf
+		r, ok := conf.Rules[rule]
+		if !conf.Enable || !ok || r.Limit <= 0 || r.Window <= 0 {
+			c.Next()
+			return
+		}
+		key := rateLimitKey(c, rule, r.Key)
+		res, err := redisAllow(c.Request.Context(), key, r.Algorithm, r.Limit, r.Burst, r.Window)
+		if err != nil {
+			// redis 不可用时降级为进程内限流
+			logRateLimitErr(err)
+			res = localLimiter.allow(key, r.Limit, r.Burst, r.Window)
+		}
+		c.Header("RateLimit-Limit", strconv.FormatInt(res.limit, 10))
+		c.Header("RateLimit-Remaining", strconv.FormatInt(max(res.remaining, 0), 10))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.reset)))
+		if !res.allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(res.reset)))
+			c.JSON(http.StatusTooManyRequests, pkg.Fail(pkg.TooManyRequestsErrCode))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 限流计数的维度 ip、user(登录用户id)、route(整个路由共享)、ip_route(每个ip在每个路由上单独计数)
+func rateLimitKey(c *gin.Context, rule, by string) string {
+	var id string
+	switch by {
+	case "user":
+		if currentUser, ok := CurrentUser(c); ok {
+			id = "user:" + strconv.FormatUint(uint64(currentUser.UserID), 10)
+		} else {
+			id = "ip:" + c.ClientIP()
+		}
+	case "route":
+		id = "route:" + c.Request.Method + ":" + c.FullPath()
+	case "ip_route":
+		id = "ip:" + c.ClientIP() + ":" + c.Request.Method + ":" + c.FullPath()
+	default:
+		id = "ip:" + c.ClientIP()
+	}
+	return rule + ":" + id
+}
+
+// hs:ginwebproject1:ratelimit:<rule>:<维度>  令牌桶的剩余令牌和更新时间
+func tokenBucketKey(key string) string {
+	return fmt.Sprintf("hs:ginwebproject1:ratelimit:%v", key)
+}
+
+// zs:ginwebproject1:ratelimit:<rule>:<维度>  滑动窗口内的请求时间
+func slidingWindowKey(key string) string {
+	return fmt.Sprintf("zs:ginwebproject1:ratelimit:%v", key)
+}
+
+func redisAllow(ctx context.Context, key, algorithm string, limit, burst int64, window time.Duration) (*rateResult, error) {
+	now := time.Now().UnixMilli()
+	if algorithm == AlgTokenBucket {
+		capacity := burst
+		if capacity <= 0 {
+			capacity = limit
+		}
+		rate := float64(limit) / float64(window.Milliseconds())
+		vals, err := tokenBucketScript.Run(ctx, config.RedisClient,
+			[]string{tokenBucketKey(key)},
+			now, strconv.FormatFloat(rate, 'f', -1, 64), capacity).Int64Slice()
+		if err != nil {
+			return nil, err
+		}
+		return &rateResult{
+			allowed:   vals[0] == 1,
+			limit:     capacity,
+			remaining: vals[1],
+			reset:     time.Duration(vals[2]) * time.Millisecond,
+		}, nil
+	}
+	member, err := pkg.RandomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := slidingWindowScript.Run(ctx, config.RedisClient,
+		[]string{slidingWindowKey(key)},
+		now, window.Milliseconds(), limit, strconv.FormatInt(now, 10)+"-"+member).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return &rateResult{
+		allowed:   vals[0] == 1,
+		limit:     limit,
+		remaining: vals[1],
+		reset:     time.Duration(vals[2]) * time.Millisecond,
+	}, nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// redis 故障时每个请求都会出错 日志最多每10秒记录一次
+var lastRateLimitErrLog atomic.Int64
+
+func logRateLimitErr(err error) {
+	now := time.Now().Unix()
+	last := lastRateLimitErrLog.Load()
+	if now-last >= 10 && lastRateLimitErrLog.CompareAndSwap(last, now) {
+		zap.S().Errorf("RateLimit redis不可用 降级为进程内限流 err:%v", err)
+	}
+}
+
+// 进程内令牌桶 只在redis不可用时使用 多实例部署时每个实例单独计数
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var localLimiter = &memoryLimiter{buckets: map[string]*memoryBucket{}}
+
+func (l *memoryLimiter) allow(key string, limit, burst int64, window time.Duration) *rateResult {
+	capacity := burst
+	if capacity <= 0 {
+		capacity = limit
+	}
+	rate := float64(limit) / float64(window) // 每纳秒补充的令牌数
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 清理已经补满的桶 防止key无限增长
+	if len(l.buckets) > 10000 {
+		for k, b := range l.buckets {
+			if b.tokens+float64(now.Sub(b.last))*rate >= float64(capacity) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(capacity), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(capacity), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	res := &rateResult{limit: capacity}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+		res.reset = time.Duration(math.Ceil((float64(capacity) - b.tokens) / rate))
+	} else {
+		res.reset = time.Duration(math.Ceil((1 - b.tokens) / rate))
+	}
+	res.remaining = int64(b.tokens)
+	return res
+}
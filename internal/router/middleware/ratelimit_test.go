@@ -0,0 +1,107 @@
+package middleware_test
+
+import (
+	"encoding/json"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/router/middleware"
+	"ginwebproject1/internal/testutil"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 只挂载一个使用指定规则的接口
+func setupRateLimit(t *testing.T, rule string, r config.RateLimitRule) (*testutil.Env, *gin.Engine) {
+	t.Helper()
+	env := testutil.Setup(t, func(c *config.ServerConfig) {
+		c.RateLimitConf.Enable = true
+		c.RateLimitConf.Rules = map[string]config.RateLimitRule{rule: r}
+	})
+	engine := gin.New()
+	engine.GET("/ping", middleware.RateLimit(rule), func(c *gin.Context) {
+		c.JSON(http.StatusOK, pkg.Success())
+	})
+	return env, engine
+}
+
+func ping(engine *gin.Engine, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+// 依次请求 检查剩余次数 最后一次应被拒绝
+func expectLimited(t *testing.T, engine *gin.Engine, ip string, limit int) *httptest.ResponseRecorder {
+	t.Helper()
+	for i := 1; i <= limit; i++ {
+		w := ping(engine, ip)
+		if w.Code != http.StatusOK {
+			t.Fatalf("第%v次请求应允许 status:%v", i, w.Code)
+		}
+		if got, want := w.Header().Get("RateLimit-Remaining"), limit-i; got != strconv.Itoa(want) {
+			t.Fatalf("第%v次请求剩余次数 got:%v want:%v", i, got, want)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != strconv.Itoa(limit) {
+			t.Fatalf("RateLimit-Limit got:%v", got)
+		}
+	}
+	w := ping(engine, ip)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("超过上限后应返回429 status:%v", w.Code)
+	}
+	var r testutil.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil || r.Code != pkg.TooManyRequestsErrCode {
+		t.Fatalf("429响应 body:%s", w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("429响应头 got:%v", w.Header())
+	}
+	return w
+}
+
+func TestRateLimitSlidingWindow(t *testing.T) {
+	env, engine := setupRateLimit(t, "test_window", config.RateLimitRule{
+		Algorithm: middleware.AlgSlidingWindow, Key: "ip", Limit: 3, Window: time.Minute,
+	})
+	w := expectLimited(t, engine, "192.0.2.1", 3)
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("窗口内最早的请求过期后恢复 Retry-After got:%v", got)
+	}
+	if !env.Redis.Exists("zs:ginwebproject1:ratelimit:test_window:ip:192.0.2.1") {
+		t.Fatalf("应使用redis计数")
+	}
+	// 其他ip单独计数
+	if w := ping(engine, "192.0.2.2"); w.Code != http.StatusOK {
+		t.Fatalf("其他ip不应受影响 status:%v", w.Code)
+	}
+}
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	env, engine := setupRateLimit(t, "test_bucket", config.RateLimitRule{
+		Algorithm: middleware.AlgTokenBucket, Key: "ip", Limit: 60, Window: time.Minute, Burst: 2,
+	})
+	// 容量为 burst 每秒补充一个令牌
+	w := expectLimited(t, engine, "192.0.2.1", 2)
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("下一个令牌的等待时间 Retry-After got:%v", got)
+	}
+	if !env.Redis.Exists("hs:ginwebproject1:ratelimit:test_bucket:ip:192.0.2.1") {
+		t.Fatalf("应使用redis计数")
+	}
+}
+
+func TestRateLimitRedisDown(t *testing.T) {
+	env, engine := setupRateLimit(t, "test_fallback", config.RateLimitRule{
+		Algorithm: middleware.AlgSlidingWindow, Key: "ip", Limit: 2, Window: time.Minute,
+	})
+	// redis 不可用时降级为进程内令牌桶 仍然限流
+	env.Redis.Close()
+	expectLimited(t, engine, "192.0.2.1", 2)
+}
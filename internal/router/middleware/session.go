@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"ginwebproject1/internal/cache"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 最近访问时间的精度 每个实例对同一会话在该间隔内只写一次redis
+const sessionTouchInterval = time.Minute
+
+var sessionTouched = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// 更新会话的最近访问时间和ip 失败只记录日志 不影响请求
+func touchSession(c *gin.Context, sid string) {
+	now := time.Now()
+	sessionTouched.Lock()
+	if now.Sub(sessionTouched.m[sid]) < sessionTouchInterval {
+		sessionTouched.Unlock()
+		return
+	}
+	// 清理过期的记录 防止无限增长
+	if len(sessionTouched.m) > 10000 {
+		for k, t := range sessionTouched.m {
+			if now.Sub(t) >= sessionTouchInterval {
+				delete(sessionTouched.m, k)
+			}
+		}
+	}
+	sessionTouched.m[sid] = now
+	sessionTouched.Unlock()
+	if err := cache.TouchSession(c.Request.Context(), sid, c.ClientIP(), 0); err != nil {
+		zap.S().Errorf("touchSession.cache.TouchSession sid:%v err:%v", sid, err)
+	}
+}
@@ -1,7 +1,11 @@
 package router
 
 import (
+	"net/http"
+
 	"ginwebproject1/internal/logic"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/oidc"
 	"ginwebproject1/internal/router/middleware"
 
 	"github.com/gin-contrib/cors"
@@ -15,13 +19,93 @@ func InitRouter() *gin.Engine {
 	router.Use(cors.Default())
 	// 注册post请求路径  logic.Register用于处理请求
 	// 配置路由后，可以用POST方式访问地址127.0.0.1:9091/register触发logic.Register函数的代码逻辑
-	router.POST("register", logic.Register)
-	router.POST("login", logic.Login)
+	// 未登录接口按ip限流
+	auth := middleware.RateLimit("auth")
+	router.POST("register", auth, logic.Register)
+	router.POST("login", auth, logic.Login)
+	// 开启两步验证的账号 使用登录返回的 mfa_token 和验证码完成登录
+	router.POST("login/mfa", auth, logic.LoginMFA)
+	// 使用refresh token换取新的令牌对
+	router.POST("token/refresh", auth, logic.Refresh)
+	// 邮箱验证
+	router.POST("verify-email", auth, logic.VerifyEmail)
+	router.POST("verify-email/resend", auth, logic.ResendVerifyEmail)
+	// 找回密码
+	router.POST("password/forgot", auth, logic.ForgotPassword)
+	router.POST("password/reset", auth, logic.ResetPassword)
+	// 第三方登录 授权码 + PKCE
+	router.GET("oauth/:provider/login", auth, logic.OIDCLogin)
+	router.GET("oauth/:provider/callback", auth, logic.OIDCCallback)
+	// 内置的测试OIDC提供方 只在开启 oidc.fake 时挂载
+	if fake, prefix := oidc.FakeProvider(); fake != nil {
+		router.Any(prefix+"/*path", gin.WrapH(http.StripPrefix(prefix, fake)))
+	}
+	// 公开验证token用的公钥
+	router.GET(".well-known/jwks.json", logic.JWKS)
+	// 作为授权服务器 供接入的应用使用
+	router.GET(".well-known/openid-configuration", logic.OpenIDConfiguration)
+	router.GET("oauth2/authorize", auth, logic.Authorize)
+	router.POST("oauth2/token", auth, logic.OAuthToken)
+	router.POST("oauth2/introspect", logic.IntrospectOAuthToken)
+	router.POST("oauth2/revoke", auth, logic.RevokeOAuthToken)
+	router.GET("oauth2/userinfo", logic.OAuthUserInfo)
+	{
+		// 授权确认页 用户需要先登录本服务
+		consent := router.Group("oauth2/consent").Use(middleware.VerifyJWT(), middleware.RateLimit("user"))
+		consent.GET(":id", logic.GetOAuthConsent)
+		consent.POST(":id", logic.SubmitOAuthConsent)
+	}
 	{
-		g1 := router.Group("user").Use(middleware.VerifyJWT())
-		g1.POST("info", logic.Info)
-		g1.POST("update", logic.Update)
+		// 同时支持 API key 访问的接口 API key 需要 profile scope
+		keyed := router.Group("user").Use(middleware.Authenticate(), middleware.RateLimit("user"), middleware.RequireScope(model.ScopeProfile))
+		keyed.POST("info", logic.Info)
+		keyed.POST("update", logic.Update)
+		// 登录历史和安全记录
+		keyed.GET("security-events", logic.ListMySecurityEvents)
+	}
+	{
+		// 账号安全相关的接口 只允许登录用户访问
+		g1 := router.Group("user").Use(middleware.VerifyJWT(), middleware.RateLimit("user"))
 		g1.POST("Delete", logic.Delete)
+		g1.POST("logout", logic.Logout)
+		g1.POST("password", logic.ChangePassword)
+		// 登录设备管理
+		g1.GET("sessions", logic.ListSessions)
+		g1.DELETE("sessions/:id", logic.RevokeSession)
+		// 两步验证
+		g1.GET("mfa", logic.MFAStatus)
+		g1.POST("mfa/totp/setup", logic.SetupTOTP)
+		g1.POST("mfa/totp/confirm", logic.ConfirmTOTP)
+		g1.POST("mfa/totp/disable", logic.DisableTOTP)
+		g1.POST("mfa/recovery-codes", logic.RegenerateRecoveryCodes)
+		// 绑定的第三方登录
+		g1.GET("identities", logic.ListIdentities)
+		g1.DELETE("identities/:id", logic.UnlinkIdentity)
+		// 已授权的OAuth应用
+		g1.GET("oauth/consents", logic.ListOAuthConsents)
+		g1.DELETE("oauth/consents/:id", logic.RevokeOAuthConsent)
+		// 服务间调用使用的 API key
+		g1.GET("api-keys", logic.ListAPIKeys)
+		g1.POST("api-keys", logic.CreateAPIKey)
+		g1.DELETE("api-keys/:id", logic.RevokeAPIKey)
+	}
+	{
+		// 管理后台 每个接口按权限控制 也可使用带对应scope的 API key
+		admin := router.Group("admin").Use(middleware.Authenticate(), middleware.RequireMFA(), middleware.RateLimit("admin"))
+		admin.GET("roles", middleware.RequirePermission(model.PermRolesRead), logic.ListRoles)
+		admin.PUT("users/:id/roles", middleware.RequirePermission(model.PermRolesWrite), logic.SetUserRoles)
+		admin.GET("users", middleware.RequirePermission(model.PermUsersRead), logic.ListUsers)
+		admin.GET("users/:id", middleware.RequirePermission(model.PermUsersRead), logic.GetUser)
+		admin.POST("users/:id/disable", middleware.RequirePermission(model.PermUsersWrite), logic.DisableUser)
+		admin.POST("users/:id/enable", middleware.RequirePermission(model.PermUsersWrite), logic.EnableUser)
+		admin.POST("users/:id/unlock", middleware.RequirePermission(model.PermUsersWrite), logic.UnlockUser)
+		admin.GET("users/:id/api-keys", middleware.RequirePermission(model.PermUsersRead), logic.ListUserAPIKeys)
+		admin.DELETE("api-keys/:id", middleware.RequirePermission(model.PermUsersWrite), logic.AdminRevokeAPIKey)
+		admin.GET("security-events", middleware.RequirePermission(model.PermAuditRead), logic.ListSecurityEvents)
+		admin.GET("cache/stats", middleware.RequirePermission(model.PermCacheRead), logic.CacheStats)
+		admin.GET("oauth/clients", middleware.RequirePermission(model.PermOAuthClientsRead), logic.ListOAuthClients)
+		admin.POST("oauth/clients", middleware.RequirePermission(model.PermOAuthClientsWrite), logic.CreateOAuthClient)
+		admin.DELETE("oauth/clients/:id", middleware.RequirePermission(model.PermOAuthClientsWrite), logic.DeleteOAuthClient)
 	}
 	return router
 }
@@ -0,0 +1,172 @@
+// 测试用的运行环境 使用内存redis和sqlite 不依赖外部服务
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ginwebproject1/internal"
+	"ginwebproject1/internal/api"
+	"ginwebproject1/internal/cache"
+	"ginwebproject1/internal/config"
+	"ginwebproject1/internal/model"
+	"ginwebproject1/internal/router"
+	"ginwebproject1/pkg"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+type Env struct {
+	Router *gin.Engine
+	Redis  *miniredis.Miniredis
+}
+
+// 接口的统一响应
+type Response struct {
+	Code pkg.Code        `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+var dbSeq atomic.Int64
+
+// 加载 etc/config.yaml 并初始化各组件 configure 在初始化之前调用 用于修改配置
+// 默认关闭限流和本地缓存 邮件只写日志 不输出日志 避免写入项目的日志文件
+func Setup(t *testing.T, configure ...func(c *config.ServerConfig)) *Env {
+	t.Helper()
+	zap.ReplaceGlobals(zap.NewNop())
+	// 配置和密钥文件使用相对项目根目录的路径
+	_, file, _, _ := runtime.Caller(0)
+	t.Chdir(filepath.Join(filepath.Dir(file), "..", ".."))
+	gin.SetMode(gin.TestMode)
+
+	internal.InitConfig()
+	c := &config.Config
+	c.RateLimitConf.Enable = false
+	c.LocalCacheConf.Enable = false
+	c.MailConf.Driver = "log"
+	for _, f := range configure {
+		f(c)
+	}
+	internal.InitPassword()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	config.RedisClient = rdb
+
+	dsn := fmt.Sprintf("file:testdb%d?mode=memory&cache=shared", dbSeq.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+	})
+	if err != nil {
+		t.Fatalf("打开sqlite失败 err:%v", err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := model.AutoMigrate(db); err != nil {
+		t.Fatalf("创建数据表失败 err:%v", err)
+	}
+	config.DB = db
+
+	config.LocalCache = nil
+	internal.InitRBAC()
+	internal.InitJWT()
+	internal.InitMailer()
+	internal.InitOIDC()
+	internal.InitLocalCache()
+	if config.LocalCache != nil {
+		t.Cleanup(func() { config.LocalCache.Close(); config.LocalCache = nil })
+	}
+	// 同步建立布隆过滤器 避免与测试中的注册并发
+	if err := cache.RebuildUserBloom(context.Background()); err != nil {
+		t.Fatalf("建立布隆过滤器失败 err:%v", err)
+	}
+	return &Env{Router: router.InitRouter(), Redis: mr}
+}
+
+// 发送请求 body 为空时不设置 Content-Type
+func (e *Env) Do(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	e.Router.ServeHTTP(w, req)
+	return w
+}
+
+// 发送json请求并解析统一响应 token 不为空时作为 Bearer token
+func (e *Env) JSON(t *testing.T, method, path, body, token string) Response {
+	t.Helper()
+	header := map[string]string{}
+	if token != "" {
+		header["Authorization"] = "Bearer " + token
+	}
+	w := e.Do(method, path, body, header)
+	var r Response
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%v %v 响应不是json status:%v body:%s", method, path, w.Code, w.Body.String())
+	}
+	return r
+}
+
+// 解析响应中的 data
+func (r Response) Decode(t *testing.T, v any) {
+	t.Helper()
+	if err := json.Unmarshal(r.Data, v); err != nil {
+		t.Fatalf("解析data失败 data:%s err:%v", r.Data, err)
+	}
+}
+
+// 直接写入数据库创建一个已验证邮箱的正常用户 同时写入布隆过滤器
+func CreateUser(t *testing.T, username, password string) model.User {
+	t.Helper()
+	hashed, err := pkg.HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword err:%v", err)
+	}
+	now := time.Now()
+	u := model.User{
+		Username:        username,
+		Password:        hashed,
+		Email:           username + "@example.com",
+		Status:          model.UserStatusActive,
+		EmailVerifiedAt: &now,
+	}
+	if err := config.DB.Create(&u).Error; err != nil {
+		t.Fatalf("创建用户失败 err:%v", err)
+	}
+	cache.BloomAddUsername(context.Background(), u.Username)
+	cache.BloomAddUserID(context.Background(), u.ID)
+	return u
+}
+
+// 使用用户名密码登录 返回令牌对
+func (e *Env) Login(t *testing.T, username, password string) api.TokenResponse {
+	t.Helper()
+	r := e.JSON(t, http.MethodPost, "/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, password), "")
+	if r.Code != pkg.SuccessCode {
+		t.Fatalf("登录失败 username:%v code:%v msg:%v", username, r.Code, r.Msg)
+	}
+	var pair api.TokenResponse
+	r.Decode(t, &pair)
+	return pair
+}
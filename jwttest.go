@@ -3,15 +3,23 @@ package main
 import (
 	"fmt"
 	"ginwebproject1/internal/router/middleware"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
 func main2() {
-	jwtinfo := middleware.NewJWT()
-	claims := jwt.MapClaims{
-		"sub":  123123, // 用户 ID
-		"name": "zz",   // 用户名
+	jwtinfo, err := middleware.NewJWT()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	claims := &middleware.Claims{
+		UserID:   123123, // 用户 ID
+		Username: "zz",   // 用户名
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
 	}
 	mykey, _ := jwtinfo.GenerateJWT(claims)
 	prasetoken, _ := jwtinfo.PraseToken(mykey)
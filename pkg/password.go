@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password mismatch")
+	ErrPasswordTooLong     = errors.New("password too long")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// 旧版本使用的全局加盐字符串 仅用于校验历史bcrypt哈希
+const legacySalt = "wyzbenren"
+
+// 密码哈希算法
+// 哈希结果使用 PHC 字符串格式 $<id>$... 以便识别算法和参数
+type Hasher interface {
+	// 算法标识 如 argon2id
+	ID() string
+	// 是否能处理该哈希串
+	Match(encoded string) bool
+	Hash(password string) (string, error)
+	// 密码不匹配时返回 ErrPasswordMismatch
+	Verify(encoded, password string) error
+	// 哈希串的参数是否与当前配置不同 需要重新哈希
+	NeedsRehash(encoded string) bool
+}
+
+// argon2id 参数
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// argon2id 哈希 密码先与 pepper 做 HMAC-SHA256 再计算
+// 格式: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type Argon2idHasher struct {
+	Params Argon2Params
+	Pepper []byte
+}
+
+func (h *Argon2idHasher) ID() string { return "argon2id" }
+
+func (h *Argon2idHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *Argon2idHasher) peppered(password string) []byte {
+	if len(h.Pepper) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, h.Pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	p := h.Params
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(h.peppered(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	b64 := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64(salt), b64(key)), nil
+}
+
+// 解析 PHC 字符串 返回参数、盐和哈希值
+func (h *Argon2idHasher) decode(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+func (h *Argon2idHasher) Verify(encoded, password string) error {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey(h.peppered(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p != h.Params
+}
+
+// bcrypt 哈希 兼容旧版本 密码末尾追加全局盐 不使用 pepper
+// bcrypt 只取前72字节 超长密码直接返回 ErrPasswordTooLong 避免被静默截断
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) ID() string { return "bcrypt" }
+
+func (h *BcryptHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	salted := []byte(password + legacySalt)
+	if len(salted) > 72 {
+		return "", ErrPasswordTooLong
+	}
+	hashed, err := bcrypt.GenerateFromPassword(salted, h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (h *BcryptHasher) Verify(encoded, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password+legacySalt))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// 当前用于生成新哈希的算法 以及所有可用于校验的算法
+var (
+	currentHasher Hasher = &Argon2idHasher{Params: DefaultArgon2Params}
+	hashers              = []Hasher{currentHasher, &BcryptHasher{Cost: bcrypt.DefaultCost}}
+)
+
+// 设置当前算法 其余算法仅用于校验历史哈希
+func SetPasswordHashers(current Hasher, others ...Hasher) {
+	currentHasher = current
+	hashers = append([]Hasher{current}, others...)
+}
+
+func HashPassword(password string) (string, error) {
+	return currentHasher.Hash(password)
+}
+
+// 根据哈希串自动选择算法校验密码 不匹配时返回 ErrPasswordMismatch
+func CheckPassWord(hassedpassword, password string) error {
+	// 未设置密码的账号(通过第三方登录创建) 不能使用密码登录
+	if hassedpassword == "" {
+		return ErrPasswordMismatch
+	}
+	for _, h := range hashers {
+		if h.Match(hassedpassword) {
+			return h.Verify(hassedpassword, password)
+		}
+	}
+	return ErrUnknownPasswordHash
+}
+
+// 哈希串不是当前算法或参数已变化 登录成功后应重新哈希
+func NeedsRehash(hassedpassword string) bool {
+	if !currentHasher.Match(hassedpassword) {
+		return true
+	}
+	return currentHasher.NeedsRehash(hassedpassword)
+}
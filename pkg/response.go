@@ -24,8 +24,9 @@ const SuccessCode Code = 0
 const (
 	// 公共错误码 00
 
-	ParamsErrCode         Code = 40000
-	RecordNotFoundErrCode Code = 40001
+	ParamsErrCode          Code = 40000
+	RecordNotFoundErrCode  Code = 40001
+	TooManyRequestsErrCode Code = 40002
 
 	//用户业务错误码 01
 
@@ -33,6 +34,25 @@ const (
 	UserTokenErrCode       Code = 40101
 	UserPasswordErrCode    Code = 40102
 	UserEmailExistsErrCode Code = 40103
+	UserRefreshErrCode     Code = 40104
+	UserCSRFErrCode        Code = 40105
+	UserPermissionErrCode  Code = 40106
+	UserDisabledErrCode    Code = 40107
+	UserResetTokenErrCode  Code = 40108
+	UserNotVerifiedErrCode Code = 40109
+	UserVerifyErrCode      Code = 40110
+	UserLockedErrCode      Code = 40111
+	UserMFATokenErrCode    Code = 40112
+	UserMFACodeErrCode     Code = 40113
+	UserMFAEnabledErrCode  Code = 40114
+	UserMFASetupErrCode    Code = 40115
+	UserMFARequiredErrCode Code = 40116
+	UserAPIKeyErrCode      Code = 40117
+	UserAPIKeyLimitErrCode Code = 40118
+	UserOIDCErrCode        Code = 40119
+	UserOIDCEmailErrCode   Code = 40120
+	UserIdentityErrCode    Code = 40121
+	OAuthRequestErrCode    Code = 40122
 )
 
 // 系统错误 5xxxx
@@ -46,12 +66,32 @@ func init() {
 	// 400xx错误message
 	message[ParamsErrCode] = "参数错误"
 	message[RecordNotFoundErrCode] = "记录不存在"
+	message[TooManyRequestsErrCode] = "请求过于频繁"
 
 	// 401xx错误message
 	message[UserExistsErrCode] = "用户已经存在"
 	message[UserTokenErrCode] = "登录信息错误"
 	message[UserPasswordErrCode] = "密码错误"
 	message[UserEmailExistsErrCode] = "邮箱已经存在"
+	message[UserRefreshErrCode] = "refresh token无效或已过期"
+	message[UserCSRFErrCode] = "CSRF校验失败"
+	message[UserPermissionErrCode] = "权限不足"
+	message[UserDisabledErrCode] = "账号已被禁用"
+	message[UserResetTokenErrCode] = "重置链接无效或已过期"
+	message[UserNotVerifiedErrCode] = "邮箱未验证"
+	message[UserVerifyErrCode] = "验证链接无效或已过期"
+	message[UserLockedErrCode] = "登录失败次数过多 请稍后再试"
+	message[UserMFATokenErrCode] = "两步验证已过期 请重新登录"
+	message[UserMFACodeErrCode] = "验证码错误"
+	message[UserMFAEnabledErrCode] = "已开启两步验证"
+	message[UserMFASetupErrCode] = "未开启两步验证或尚未发起绑定"
+	message[UserMFARequiredErrCode] = "需要使用两步验证登录"
+	message[UserAPIKeyErrCode] = "API key无效或已过期"
+	message[UserAPIKeyLimitErrCode] = "API key数量已达上限"
+	message[UserOIDCErrCode] = "第三方登录失败"
+	message[UserOIDCEmailErrCode] = "第三方账号邮箱未验证"
+	message[UserIdentityErrCode] = "不能解绑唯一的登录方式"
+	message[OAuthRequestErrCode] = "授权请求不存在或已过期"
 
 	// 5xxxx错误message
 	message[InternalErrCode] = "系统内部发生错误"
@@ -1,19 +1,23 @@
 package pkg
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
 
-// 加盐字符串（salt），用于增加加密后的复杂度。
-const salt = "wyzbenren"
-
-func HashPassword(password string) string {
-	// hash 加密密码
-	saltedPassword := password + salt
-	// Cost 决定了加密操作的复杂度
-	hassedPassword, _ := bcrypt.GenerateFromPassword([]byte(saltedPassword), bcrypt.DefaultCost)
-	return string(hassedPassword)
+// 生成 n 字节的随机串 以url安全的base64返回 用于refresh token等不透明令牌
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func CheckPassWord(hassedpassword, password string) error {
-	saltedpassword := password + salt
-	return bcrypt.CompareHashAndPassword([]byte(hassedpassword), []byte(saltedpassword))
+// 计算token的sha256摘要 redis中只保存摘要 防止泄露后被直接使用
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }